@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleExport streams all records as JSON Lines.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if primary == nil {
+		writeError(w, http.StatusNotImplemented, "export requires the log engine with a single shard")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if n, err := primary.Export(w); err != nil {
+		// The status is already sent, so the client sees a truncated body.
+		log.Printf("export failed after %d records: %s", n, err)
+	}
+}
+
+// handleImport stores JSON Lines records from the request body.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if primary == nil {
+		writeError(w, http.StatusNotImplemented, "import requires the log engine with a single shard")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if follower != nil {
+		writeError(w, http.StatusForbidden, "read-only follower")
+		return
+	}
+
+	n, err := primary.Import(r.Body)
+	if err != nil {
+		status, code := http.StatusBadRequest, codeBadRequest
+		if errors.Is(err, datastore.ErrImportNotEmpty) {
+			status, code = http.StatusConflict, codeConflict
+		}
+		writeJSON(w, status, map[string]any{
+			"imported": n,
+			"error":    apiError{Code: code, Message: err.Error()},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"imported": n})
+}
+
+// handleBackup stores a backup in the directory given by the target
+// parameter, a path on the host of the service.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if primary == nil {
+		writeError(w, http.StatusNotImplemented, "backups require the log engine with a single shard")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "missing target parameter")
+		return
+	}
+	full, _ := strconv.ParseBool(r.URL.Query().Get("full"))
+
+	info, err := primary.Backup(target, full)
+	if err != nil {
+		log.Printf("backup to %s failed: %s", target, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleHotKeys reports the most accessed keys, up to the n parameter, and
+// resets the statistics on DELETE.
+func handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := db.(datastore.HotKeyReporter)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "hot keys are not supported by the storage engine")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		n := 10
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid n parameter")
+				return
+			}
+		}
+		hot, ok := reporter.HotKeys(n)
+		if !ok {
+			writeError(w, http.StatusNotFound, "hot key sampling is disabled, see -hotkeys-sample-rate")
+			return
+		}
+		writeJSON(w, http.StatusOK, hot)
+	case http.MethodDelete:
+		reporter.ResetHotKeys()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleMerge merges the closed segments on POST.
+func handleMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	m, ok := db.(interface{ MergeSegments() error })
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "merges are not supported by the storage engine")
+		return
+	}
+	start := time.Now()
+	if err := m.MergeSegments(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"duration": time.Since(start).String(),
+		"segments": db.Stats().SegmentCount,
+	})
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, db.Stats())
+}
+
+// handleSegments lists the data files with their live and dead bytes.
+func handleSegments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	st := db.Stats()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":   st.Active,
+		"segments": st.Segments,
+	})
+}
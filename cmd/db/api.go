@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// Error codes of JSON error bodies.
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidKey       = "invalid_key"
+	codeInvalidJSON      = "invalid_json"
+	codeEmptyValue       = "empty_value"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeReadOnly         = "read_only"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeGone             = "gone"
+	codeInternal         = "internal"
+	codeNotImplemented   = "not_implemented"
+	codeUnavailable      = "unavailable"
+	codeTooLarge         = "too_large"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeBadRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeReadOnly,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusGone:                  codeGone,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusNotImplemented:        codeNotImplemented,
+	http.StatusServiceUnavailable:    codeUnavailable,
+	http.StatusRequestEntityTooLarge: codeTooLarge,
+}
+
+// maxRawValueSize limits the bodies of values stored with their content type.
+const maxRawValueSize = 16 << 20
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends a JSON error body with the default code of the status.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorCode(w, status, statusCodes[status], message)
+}
+
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]apiError{"error": {Code: code, Message: message}})
+}
+
+// handleKey serves /db/{key} and /db/{bucket}/{key}:
+//
+//	GET     200 with the value, 404 if missing
+//	HEAD    200 or 404 without a body
+//	PUT     upsert, 201 if the key was created, 200 if it was replaced
+//	POST    same as PUT
+//	DELETE  204, 404 if missing
+//
+// PUT and POST take {"value": "..."} by default. A body of any other
+// Content-Type, e.g. application/octet-stream, is stored as is together with
+// its type, and GET returns such values raw with the stored Content-Type.
+func handleKey(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len("/db/"):]
+	target, key, err := resolveKey(path)
+	if err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidKey, err.Error())
+		return
+	}
+	if key == "" {
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidKey, "empty key")
+		return
+	}
+	op := opWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		op = opRead
+	}
+	if !callerFrom(r.Context()).authorize(op, path) {
+		writeForbidden(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		switch info, err := stat(target, key); {
+		case errors.Is(err, datastore.ErrNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			if info.ContentType != "" {
+				w.Header().Set("Content-Type", info.ContentType)
+				w.Header().Set("Content-Length", strconv.Itoa(info.Size))
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	case http.MethodGet:
+		val, contentType, err := getTyped(target, key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "cannot read value")
+			return
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, val)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"key":   key,
+			"value": val,
+		})
+	case http.MethodPut, http.MethodPost:
+		if follower != nil {
+			writeError(w, http.StatusForbidden, "read-only follower")
+			return
+		}
+		contentType, raw, err := rawContentType(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid Content-Type")
+			return
+		}
+		if raw {
+			putRaw(w, r, target, key, contentType)
+			return
+		}
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codeInvalidJSON, "invalid JSON")
+			return
+		}
+		if body.Value == "" {
+			writeErrorCode(w, http.StatusBadRequest, codeEmptyValue, "value must not be empty, use DELETE to remove a key")
+			return
+		}
+		found, err := swap(target, key, body.Value, "")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "cannot save value")
+			return
+		}
+		status := http.StatusCreated
+		if found {
+			status = http.StatusOK
+		}
+		writeJSON(w, status, map[string]string{
+			"key":   key,
+			"value": body.Value,
+		})
+	case http.MethodDelete:
+		if follower != nil {
+			writeError(w, http.StatusForbidden, "read-only follower")
+			return
+		}
+		found, err := swap(target, key, "", "")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "cannot delete value")
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, datastore.ErrNotFound.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// getTyped reads key with its content type where the store keeps one.
+func getTyped(target keyValue, key string) (string, string, error) {
+	if ts, ok := target.(datastore.TypedStore); ok {
+		return ts.GetTyped(key)
+	}
+	val, err := target.Get(key)
+	return val, "", err
+}
+
+// stat describes the value of key, from the index and record headers where
+// the store can do that without reading the value.
+func stat(target keyValue, key string) (datastore.ValueInfo, error) {
+	if st, ok := target.(datastore.Stater); ok {
+		return st.Stat(key)
+	}
+	val, contentType, err := getTyped(target, key)
+	return datastore.ValueInfo{Size: len(val), ContentType: contentType}, err
+}
+
+// swap stores value, or deletes key for an empty value, and tells whether
+// key existed. Stores without Swapper check and write in two steps.
+func swap(target keyValue, key, value, contentType string) (bool, error) {
+	if sw, ok := target.(datastore.Swapper); ok {
+		return sw.Swap(key, value, contentType)
+	}
+	_, err := target.Get(key)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return false, err
+	}
+	found := err == nil
+	switch {
+	case value == "":
+		if found {
+			err = target.Delete(key)
+		}
+	case contentType != "":
+		err = target.(datastore.TypedStore).PutTyped(key, value, contentType)
+	default:
+		err = target.Put(key, value)
+	}
+	return found, err
+}
+
+// rawContentType tells whether the body of r is a raw value rather than the
+// JSON default, and returns its media type.
+func rawContentType(r *http.Request) (string, bool, error) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return "", false, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", false, err
+	}
+	return header, mediaType != "application/json", nil
+}
+
+func putRaw(w http.ResponseWriter, r *http.Request, target keyValue, key, contentType string) {
+	if _, ok := target.(datastore.TypedStore); !ok {
+		writeError(w, http.StatusNotImplemented, "the engine cannot store values with a content type")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRawValueSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("value must not exceed %d bytes", maxRawValueSize))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "cannot read body")
+		return
+	}
+	if len(data) == 0 {
+		writeErrorCode(w, http.StatusBadRequest, codeEmptyValue, "value must not be empty, use DELETE to remove a key")
+		return
+	}
+	found, err := swap(target, key, string(data), contentType)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "cannot save value")
+		return
+	}
+	status := http.StatusCreated
+	if found {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, map[string]any{
+		"key":         key,
+		"contentType": contentType,
+		"size":        len(data),
+	})
+}
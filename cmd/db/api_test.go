@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/replication"
+)
+
+// setupDb opens a datastore in a temporary directory as the one served by
+// the handlers.
+func setupDb(t *testing.T) http.Handler {
+	t.Helper()
+	var err error
+	primary, err = datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, follower = primary, nil
+	t.Cleanup(func() {
+		_ = primary.Close()
+		db, primary = nil, nil
+	})
+	return newHandler()
+}
+
+func do(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, path, nil)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("error body is not JSON: %v", err)
+	}
+	return body.Error.Code
+}
+
+func TestKeyAPI(t *testing.T) {
+	h := setupDb(t)
+
+	steps := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodGet, "/db/k", "", http.StatusNotFound, codeNotFound},
+		{http.MethodHead, "/db/k", "", http.StatusNotFound, ""},
+		{http.MethodPut, "/db/k", `{"value":"v1"}`, http.StatusCreated, ""},
+		{http.MethodPut, "/db/k", `{"value":"v2"}`, http.StatusOK, ""},
+		{http.MethodPost, "/db/other", `{"value":"x"}`, http.StatusCreated, ""},
+		{http.MethodHead, "/db/k", "", http.StatusOK, ""},
+		{http.MethodPut, "/db/k", `{"value":`, http.StatusBadRequest, codeInvalidJSON},
+		{http.MethodPut, "/db/k", `{"value":""}`, http.StatusBadRequest, codeEmptyValue},
+		{http.MethodPut, "/db/%00m%00k", `{"value":"v"}`, http.StatusBadRequest, codeInvalidKey},
+		{http.MethodPatch, "/db/k", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodDelete, "/db/k", "", http.StatusNoContent, ""},
+		{http.MethodDelete, "/db/k", "", http.StatusNotFound, codeNotFound},
+		{http.MethodGet, "/db/k", "", http.StatusNotFound, codeNotFound},
+	}
+	for _, s := range steps {
+		rec := do(t, h, s.method, s.path, s.body)
+		if rec.Code != s.status {
+			t.Fatalf("%s %q: status %d, expected %d (%s)", s.method, s.path, rec.Code, s.status, rec.Body)
+		}
+		if s.method == http.MethodHead && rec.Body.Len() != 0 {
+			t.Errorf("HEAD %q returned a body", s.path)
+		}
+		if s.code != "" {
+			if code := errorCode(t, rec); code != s.code {
+				t.Errorf("%s %q: error code %q, expected %q", s.method, s.path, code, s.code)
+			}
+		}
+	}
+
+	rec := do(t, h, http.MethodGet, "/db/other", "")
+	var got map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["key"] != "other" || got["value"] != "x" {
+		t.Errorf("GET returned %v", got)
+	}
+}
+
+func TestKeyAPI_ConcurrentCreate(t *testing.T) {
+	h := setupDb(t)
+
+	const clients = 64
+	statuses := make(chan int, clients)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			req := httptest.NewRequest(http.MethodPut, "/db/k", strings.NewReader(`{"value":"v"}`))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			statuses <- rec.Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(statuses)
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Errorf("PUT returned %d", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d PUTs reported creating the key, expected 1", created)
+	}
+}
+
+func TestKeyAPI_Raw(t *testing.T) {
+	h := setupDb(t)
+
+	put := func(path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	blob := "\x00\x01\xff binary"
+	if rec := put("/db/blob", "application/octet-stream", blob); rec.Code != http.StatusCreated {
+		t.Fatalf("raw PUT: %d (%s)", rec.Code, rec.Body)
+	}
+	rec := do(t, h, http.MethodGet, "/db/blob", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != blob {
+		t.Errorf("raw GET: %d %q", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("raw GET Content-Type: %q", ct)
+	}
+	rec = do(t, h, http.MethodHead, "/db/blob", "")
+	if rec.Header().Get("Content-Length") != strconv.Itoa(len(blob)) || rec.Body.Len() != 0 {
+		t.Errorf("raw HEAD: %v", rec.Header())
+	}
+
+	if rec := put("/db/note", "text/plain; charset=utf-8", "hello"); rec.Code != http.StatusCreated {
+		t.Fatalf("text PUT: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/db/note", ""); rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("stored Content-Type was not echoed: %q", rec.Header().Get("Content-Type"))
+	}
+
+	// JSON replaces a raw value and is returned as JSON again.
+	if rec := put("/db/blob", "application/json", `{"value":"v"}`); rec.Code != http.StatusOK {
+		t.Fatalf("JSON PUT over a raw value: %d", rec.Code)
+	}
+	rec = do(t, h, http.MethodGet, "/db/blob", "")
+	var got map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got["value"] != "v" {
+		t.Errorf("JSON GET after raw value: %v, %v", got, err)
+	}
+
+	if rec := put("/db/k", "application/octet-stream", ""); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeEmptyValue {
+		t.Errorf("empty raw PUT: %d", rec.Code)
+	}
+	if rec := put("/db/k", "text/", "x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT with an invalid Content-Type: %d", rec.Code)
+	}
+	if rec := put("/db/k", "application/octet-stream", strings.Repeat("x", maxRawValueSize+1)); rec.Code != http.StatusRequestEntityTooLarge || errorCode(t, rec) != codeTooLarge {
+		t.Errorf("oversized raw PUT: %d", rec.Code)
+	}
+}
+
+func TestKeyAPI_Buckets(t *testing.T) {
+	h := setupDb(t)
+
+	if rec := do(t, h, http.MethodPut, "/db/users/alice", `{"value":"plain"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT of a plain key: %d", rec.Code)
+	}
+	// A bucket would hide the plain key.
+	if rec := do(t, h, http.MethodPut, "/buckets/users", ""); rec.Code != http.StatusConflict || errorCode(t, rec) != codeConflict {
+		t.Fatalf("bucket created over a plain key: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodDelete, "/db/users/alice", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE of a plain key: %d", rec.Code)
+	}
+
+	if rec := do(t, h, http.MethodPut, "/buckets/users", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("bucket not created: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPut, "/db/users/alice", `{"value":"admin"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT in bucket: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/db/users/alice", ""); !strings.Contains(rec.Body.String(), `"admin"`) {
+		t.Errorf("GET in bucket: %s", rec.Body)
+	}
+	if _, err := db.Get("users/alice"); err == nil {
+		t.Errorf("bucket key is visible as a plain key")
+	}
+	if rec := do(t, h, http.MethodDelete, "/db/users/alice", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE in bucket: %d", rec.Code)
+	}
+	// Paths without an existing bucket address plain keys.
+	if rec := do(t, h, http.MethodPut, "/db/missing/k", `{"value":"v"}`); rec.Code != http.StatusCreated {
+		t.Errorf("PUT of a plain key with a slash: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodDelete, "/buckets/missing", ""); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeNotFound {
+		t.Errorf("dropping a missing bucket: %d", rec.Code)
+	}
+}
+
+func TestKeyAPI_Follower(t *testing.T) {
+	h := setupDb(t)
+	follower = replication.NewFollower("http://leader.invalid", primary)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		rec := do(t, h, method, "/db/k", `{"value":"v"}`)
+		if rec.Code != http.StatusForbidden || errorCode(t, rec) != codeReadOnly {
+			t.Errorf("%s on a follower: %d", method, rec.Code)
+		}
+	}
+}
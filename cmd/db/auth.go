@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Operations granted to tokens. Read and write are limited to the key
+// prefixes of the token, admin covers the endpoints that are not about
+// single keys.
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opAdmin = "admin"
+)
+
+var allOps = []string{opRead, opWrite, opAdmin}
+
+// principal is a client identified by its token.
+type principal struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Prefixes limit the keys the token may access, all of them if empty.
+	// Bucket keys are matched as "{bucket}/{key}".
+	Prefixes []string `json:"prefixes"`
+	Ops      []string `json:"ops"`
+}
+
+// anonymous is the principal of all requests when authentication is off.
+var anonymous = &principal{Name: "anonymous", Ops: allOps}
+
+func (p *principal) can(op string) bool {
+	return slices.Contains(p.Ops, op)
+}
+
+// covers tells whether key is within the prefixes of p. An empty key
+// stands for all keys, which only unrestricted principals cover.
+func (p *principal) covers(key string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if prefix == "" || (key != "" && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTokens reads a JSON array of principals from path.
+func loadTokens(path string) ([]*principal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tokens file: %w", err)
+	}
+	var tokens []*principal
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid tokens file %s: %w", path, err)
+	}
+	var errs []error
+	seen := make(map[string]bool)
+	for i, p := range tokens {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("token %d", i)
+		}
+		if p.Token == "" {
+			errs = append(errs, fmt.Errorf("%s: empty token", p.Name))
+		} else if seen[p.Token] {
+			errs = append(errs, fmt.Errorf("%s: duplicate token", p.Name))
+		}
+		seen[p.Token] = true
+		if len(p.Ops) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no operations", p.Name))
+		}
+		for _, op := range p.Ops {
+			if !slices.Contains(allOps, op) {
+				errs = append(errs, fmt.Errorf("%s: unknown operation %q", p.Name, op))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid tokens file %s: %w", path, err)
+	}
+	return tokens, nil
+}
+
+// principals lists the tokens of the tokens file, -auth-token, which grants
+// every operation, and -admin-token, which takes the admin operation over
+// from -auth-token.
+func (c *config) principals() []*principal {
+	ps := c.tokens[:len(c.tokens):len(c.tokens)]
+	if c.AuthToken != "" {
+		ops := allOps
+		if c.AdminToken != "" {
+			ops = []string{opRead, opWrite}
+		}
+		ps = append(ps, &principal{Name: "auth-token", Token: c.AuthToken, Ops: ops})
+	}
+	if c.AdminToken != "" {
+		ps = append(ps, &principal{Name: "admin-token", Token: c.AdminToken, Ops: []string{opAdmin}})
+	}
+	return ps
+}
+
+func (c *config) authEnabled() bool {
+	return len(c.principals()) > 0
+}
+
+// authenticate returns the principal of token, nil if the token is
+// invalid, or anonymous when authentication is off.
+func (c *config) authenticate(token string) *principal {
+	ps := c.principals()
+	if len(ps) == 0 {
+		return anonymous
+	}
+	var found *principal
+	for _, p := range ps {
+		// All tokens are compared, so the timing does not tell which one
+		// matched.
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) == 1 && found == nil {
+			found = p
+		}
+	}
+	return found
+}
+
+// caller is an authenticated client of one of the APIs.
+type caller struct {
+	*principal
+	api  string
+	addr string
+}
+
+// permits tells whether the caller may perform op on key, with an empty key
+// standing for all keys. Scans and watches are filtered with it and only
+// denied as a whole when the caller cannot read at all.
+func (c caller) permits(op, key string) bool {
+	return c.can(op) && (op == opAdmin || c.covers(key))
+}
+
+// authorize is permits with an audit of denials.
+func (c caller) authorize(op, key string) bool {
+	if c.permits(op, key) {
+		return true
+	}
+	c.deny(op, key)
+	return false
+}
+
+func (c caller) deny(op, resource string) {
+	log.Printf("audit: denied %s %s on %q to %s from %s", c.api, op, resource, c.Name, c.addr)
+}
+
+func auditUnauthenticated(api, addr, resource string) {
+	log.Printf("audit: rejected unauthenticated %s request for %q from %s", api, resource, addr)
+}
+
+type callerKey struct{}
+
+func withCaller(ctx context.Context, c caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// callerFrom returns the caller stored by the auth middleware. Without one
+// only an anonymous caller with authentication off is allowed anything.
+func callerFrom(ctx context.Context) caller {
+	if c, ok := ctx.Value(callerKey{}).(caller); ok {
+		return c
+	}
+	p := anonymous
+	if conf.authEnabled() {
+		p = &principal{Name: "anonymous"}
+	}
+	return caller{principal: p}
+}
+
+func bearerToken(header string) string {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// publicPaths are probed by orchestrators without credentials.
+var publicPaths = map[string]bool{"/health": true, "/ready": true}
+
+// routeOp returns the operation required by endpoints that are not about
+// single keys, which the key handlers authorize themselves.
+func routeOp(r *http.Request) string {
+	path := r.URL.Path
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case strings.HasPrefix(path, "/admin/"), path == "/metrics":
+		return opAdmin
+	case strings.HasPrefix(path, "/replication/"):
+		return opRead
+	case path == "/buckets", strings.HasPrefix(path, "/buckets/"), strings.HasPrefix(path, indexPath):
+		if read {
+			return opRead
+		}
+		return opAdmin
+	}
+	return ""
+}
+
+// requireToken authenticates HTTP requests by their bearer token with 401
+// for a missing or invalid one, and rejects operations the token is not
+// granted with 403.
+func requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p := conf.authenticate(bearerToken(r.Header.Get("Authorization")))
+		if p == nil {
+			auditUnauthenticated("HTTP", r.RemoteAddr, r.Method+" "+r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		c := caller{principal: p, api: "HTTP", addr: r.RemoteAddr}
+		// Bucket and index metadata, index lookups and replication span
+		// all keys.
+		if op := routeOp(r); op != "" && !c.permits(op, "") {
+			c.deny(op, r.Method+" "+r.URL.Path)
+			writeForbidden(w)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(withCaller(r.Context(), c)))
+	})
+}
+
+func writeForbidden(w http.ResponseWriter) {
+	writeErrorCode(w, http.StatusForbidden, codeForbidden, "the token is not allowed to perform this operation")
+}
+
+var errPermissionDenied = status.Error(codes.PermissionDenied, "the token is not allowed to perform this operation")
+
+// grpcAuthenticate checks the bearer token in the "authorization" metadata
+// and stores the caller in the context.
+func grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token = bearerToken(values[0])
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	p := conf.authenticate(token)
+	if p == nil {
+		auditUnauthenticated("gRPC", addr, method)
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+	return withCaller(ctx, caller{principal: p, api: "gRPC", addr: addr}), nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authedStream carries the caller in the context of a stream.
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authedStream) Context() context.Context { return s.ctx }
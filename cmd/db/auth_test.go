@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbrpc"
+)
+
+func setAuthToken(t *testing.T, token string) {
+	t.Helper()
+	conf = &config{AuthToken: token}
+	t.Cleanup(func() { conf = &config{} })
+}
+
+// setTokens configures the principals of a tokens file and returns the
+// audit log.
+func setTokens(t *testing.T, tokens ...*principal) *bytes.Buffer {
+	t.Helper()
+	conf = &config{tokens: tokens}
+	var audit bytes.Buffer
+	log.SetOutput(&audit)
+	t.Cleanup(func() {
+		conf = &config{}
+		log.SetOutput(os.Stderr)
+	})
+	return &audit
+}
+
+var testTokens = []*principal{
+	{Name: "orders", Token: "t-orders", Prefixes: []string{"orders/"}, Ops: []string{opRead, opWrite}},
+	{Name: "reader", Token: "t-reader", Ops: []string{opRead}},
+	{Name: "ops", Token: "t-ops", Ops: []string{opAdmin}},
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "tokens.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tokens, err := loadTokens(write(`[{"token": "a", "prefixes": ["x/"], "ops": ["read"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Name != "token 0" || tokens[0].covers("y/1") || !tokens[0].covers("x/1") {
+		t.Errorf("loaded %+v", tokens[0])
+	}
+
+	for content, expected := range map[string]string{
+		`[{"token": "", "ops": ["read"]}]`:                                   "empty token",
+		`[{"token": "a", "ops": ["read"]}, {"token": "a", "ops": ["read"]}]`: "duplicate token",
+		`[{"token": "a", "ops": ["delete"]}]`:                                `unknown operation "delete"`,
+		`[{"token": "a"}]`:                                                   "no operations",
+		`{}`:                                                                 "invalid tokens file",
+	} {
+		if _, err := loadTokens(write(content)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: got %v, expected %q", content, err, expected)
+		}
+	}
+}
+
+func TestAuth_Tokens(t *testing.T) {
+	h := setupDb(t)
+	audit := setTokens(t, testTokens...)
+
+	steps := []struct {
+		method, path, body, token string
+		status                    int
+	}{
+		{http.MethodPut, "/db/orders/1", `{"value":"v"}`, "t-orders", http.StatusCreated},
+		{http.MethodGet, "/db/orders/1", "", "t-orders", http.StatusOK},
+		{http.MethodPut, "/db/users/1", `{"value":"v"}`, "t-orders", http.StatusForbidden},
+		{http.MethodGet, "/db/users/1", "", "t-orders", http.StatusForbidden},
+		{http.MethodGet, "/db/orders/1", "", "t-reader", http.StatusOK},
+		{http.MethodDelete, "/db/orders/1", "", "t-reader", http.StatusForbidden},
+		{http.MethodPost, batchPath, `{"ops":[{"op":"get","key":"orders/1"},{"op":"put","key":"users/1","value":"v"}]}`, "t-orders", http.StatusForbidden},
+		{http.MethodPost, batchPath, `{"ops":[{"op":"put","key":"orders/2","value":"v"}]}`, "t-orders", http.StatusOK},
+		{http.MethodGet, "/buckets", "", "t-orders", http.StatusForbidden},
+		{http.MethodGet, "/buckets", "", "t-reader", http.StatusOK},
+		{http.MethodPut, "/buckets/orders", "", "t-reader", http.StatusForbidden},
+		{http.MethodGet, "/admin/stats", "", "t-reader", http.StatusForbidden},
+		{http.MethodGet, "/admin/stats", "", "t-ops", http.StatusOK},
+		{http.MethodGet, "/db/orders/1", "", "t-ops", http.StatusForbidden},
+		{http.MethodGet, "/db/orders/1", "", "t-unknown", http.StatusUnauthorized},
+	}
+	for _, s := range steps {
+		req := httptest.NewRequest(s.method, s.path, strings.NewReader(s.body))
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != s.status {
+			t.Fatalf("%s %s with %s: status %d, expected %d (%s)", s.method, s.path, s.token, rec.Code, s.status, rec.Body)
+		}
+		if s.status == http.StatusForbidden && errorCode(t, rec) != codeForbidden {
+			t.Errorf("%s %s with %s: unexpected error code", s.method, s.path, s.token)
+		}
+	}
+	if v, _ := db.Get("users/1"); v != "" {
+		t.Errorf("a denied batch wrote %q", v)
+	}
+
+	for _, line := range []string{
+		`audit: denied HTTP write on "users/1" to orders from`,
+		`audit: denied HTTP admin on "GET /admin/stats" to reader from`,
+		`audit: rejected unauthenticated HTTP request for "GET /db/orders/1" from`,
+	} {
+		if !strings.Contains(audit.String(), line) {
+			t.Errorf("audit log is missing %q:\n%s", line, audit)
+		}
+	}
+}
+
+func TestAuth_TokensGRPC(t *testing.T) {
+	c := setupGRPC(t)
+	setTokens(t, testTokens...)
+	for _, key := range []string{"orders/1", "orders/2", "users/1"} {
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer t-orders")
+
+	if _, err := c.Put(ctx, &dbrpc.PutRequest{Key: "users/1", Value: "x"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Put outside the prefixes: %v", err)
+	}
+	if _, err := c.Batch(ctx, &dbrpc.BatchRequest{Ops: []*dbrpc.BatchOp{{Type: dbrpc.BatchOp_TYPE_GET, Key: "users/1"}}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Batch outside the prefixes: %v", err)
+	}
+
+	stream, err := c.Scan(ctx, &dbrpc.ScanRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, kv.GetKey())
+	}
+	if strings.Join(keys, ",") != "orders/1,orders/2" {
+		t.Errorf("Scan returned %v", keys)
+	}
+}
+
+func TestAuth_TokensRESP(t *testing.T) {
+	setTokens(t, testTokens...)
+	c := setupRESP(t)
+
+	steps := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"AUTH", "t-orders"}, "+OK"},
+		{[]string{"SET", "orders/1", "v"}, "+OK"},
+		{[]string{"SET", "users/1", "v"}, "-" + string(errRESPNoPerm)},
+		{[]string{"MSET", "orders/2", "v", "users/1", "v"}, "-" + string(errRESPNoPerm)},
+		{[]string{"MGET", "orders/1", "orders/2"}, "*[$v $nil]"},
+		{[]string{"DEL", "users/1"}, "-" + string(errRESPNoPerm)},
+		{[]string{"SCAN", "0"}, "*[$0 *[$orders/1]]"},
+		{[]string{"AUTH", "t-reader"}, "+OK"},
+		{[]string{"INCRBY", "orders/n", "1"}, "-" + string(errRESPNoPerm)},
+	}
+	for _, s := range steps {
+		if reply := c.do(s.args...); reply != s.expected {
+			t.Errorf("%v: got %q, expected %q", s.args, reply, s.expected)
+		}
+	}
+}
+
+func TestAuth_HTTP(t *testing.T) {
+	h := setupDb(t)
+	setAuthToken(t, "s3cret")
+
+	for _, header := range []string{"", "Bearer wrong", "s3cret"} {
+		req := httptest.NewRequest(http.MethodGet, "/db/k", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != codeUnauthorized {
+			t.Errorf("Authorization %q: status %d", header, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/db/k", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("valid token: status %d", rec.Code)
+	}
+}
+
+func TestAuth_GRPC(t *testing.T) {
+	c := setupGRPC(t)
+	setAuthToken(t, "s3cret")
+
+	if _, err := c.Get(context.Background(), &dbrpc.GetRequest{Key: "k"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Get without a token: %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret")
+	if _, err := c.Get(ctx, &dbrpc.GetRequest{Key: "k"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get with a token: %v", err)
+	}
+	stream, err := c.Scan(context.Background(), &dbrpc.ScanRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Scan without a token: %v", err)
+	}
+}
+
+func TestAuth_RESP(t *testing.T) {
+	setAuthToken(t, "s3cret")
+	c := setupRESP(t)
+
+	steps := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"GET", "k"}, "-NOAUTH Authentication required."},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair"},
+		{[]string{"AUTH", "default", "s3cret"}, "+OK"},
+		{[]string{"GET", "k"}, "$nil"},
+	}
+	for _, s := range steps {
+		if reply := c.do(s.args...); reply != s.expected {
+			t.Errorf("%v: got %q, expected %q", s.args, reply, s.expected)
+		}
+	}
+}
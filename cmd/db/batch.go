@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	batchPath   = "/db/_batch"
+	maxBatchOps = 1000
+)
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type batchResult struct {
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`
+	Status int       `json:"status"`
+	Value  string    `json:"value,omitempty"`
+	Error  *apiError `json:"error,omitempty"`
+}
+
+// batchError rejects a batch as a whole, before any of it is written.
+type batchError struct {
+	status int
+	apiError
+}
+
+func newBatchError(status int, code string, format string, args ...any) *batchError {
+	return &batchError{status: status, apiError: apiError{Code: code, Message: fmt.Sprintf(format, args...)}}
+}
+
+func forbiddenOp(i int, op, key string) *batchError {
+	return newBatchError(http.StatusForbidden, codeForbidden, "operation %d: the token is not allowed to %s %q", i, op, key)
+}
+
+// handleBatch serves POST /db/_batch with a list of get, put and delete
+// operations on plain or bucket keys.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Ops []batchOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidJSON, "invalid JSON")
+		return
+	}
+	results, berr := runBatch(callerFrom(r.Context()), req.Ops)
+	if berr != nil {
+		writeErrorCode(w, berr.status, berr.Code, berr.Message)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]batchResult{"results": results})
+}
+
+// runBatch serves a batch of the HTTP or gRPC API, which is limited to
+// maxBatchOps operations and applied atomically.
+func runBatch(c caller, ops []batchOp) ([]batchResult, *batchError) {
+	if len(ops) > maxBatchOps {
+		return nil, newBatchError(http.StatusBadRequest, codeBadRequest, "at most %d operations are allowed per batch", maxBatchOps)
+	}
+	return evalBatch(c, ops, true)
+}
+
+// evalBatch validates and authorizes all operations, then evaluates them in
+// request order. Batches with writes run as one transaction, so their reads
+// see the writes listed before them and nothing else lands in between.
+// Unless atomic is set, stores that cannot run transactions apply the
+// operations one by one instead.
+func evalBatch(c caller, ops []batchOp, atomic bool) ([]batchResult, *batchError) {
+	targets := make([]keyValue, len(ops))
+	keys := make([]string, len(ops))
+	raws := make([]string, len(ops))
+	writes := false
+	for i, op := range ops {
+		target, key, err := resolveKey(op.Key)
+		if err == nil && key == "" {
+			err = errors.New("empty key")
+		}
+		if err != nil {
+			return nil, newBatchError(http.StatusBadRequest, codeInvalidKey, "operation %d: %s", i, err)
+		}
+		targets[i], keys[i], raws[i] = target, key, key
+		if b, ok := target.(*datastore.Bucket); ok {
+			raws[i] = b.RawKey(key)
+		}
+
+		switch op.Op {
+		case "get":
+			if !c.authorize(opRead, op.Key) {
+				return nil, forbiddenOp(i, "read", op.Key)
+			}
+		case "put":
+			if !c.authorize(opWrite, op.Key) {
+				return nil, forbiddenOp(i, "write", op.Key)
+			}
+			if op.Value == "" {
+				return nil, newBatchError(http.StatusBadRequest, codeEmptyValue, "operation %d: value must not be empty", i)
+			}
+			writes = true
+		case "delete":
+			if !c.authorize(opWrite, op.Key) {
+				return nil, forbiddenOp(i, "write", op.Key)
+			}
+			writes = true
+		default:
+			return nil, newBatchError(http.StatusBadRequest, codeBadRequest, "operation %d: unknown operation %q", i, op.Op)
+		}
+	}
+
+	results := make([]batchResult, len(ops))
+	if !writes {
+		for i, op := range ops {
+			val, err := targets[i].Get(keys[i])
+			results[i] = readResult(op, val, err)
+		}
+		return results, nil
+	}
+
+	if follower != nil {
+		return nil, newBatchError(http.StatusForbidden, codeReadOnly, "read-only follower")
+	}
+	tr, ok := db.(datastore.Transactor)
+	if !ok && atomic {
+		return nil, newBatchError(http.StatusNotImplemented, codeNotImplemented, "batch writes are not supported by the storage engine")
+	}
+	if !ok {
+		for i, op := range ops {
+			var err error
+			switch op.Op {
+			case "get":
+				val, err := targets[i].Get(keys[i])
+				results[i] = readResult(op, val, err)
+				continue
+			case "put":
+				err = targets[i].Put(keys[i], op.Value)
+				results[i] = batchResult{Op: op.Op, Key: op.Key, Status: http.StatusOK}
+			case "delete":
+				err = targets[i].Delete(keys[i])
+				results[i] = batchResult{Op: op.Op, Key: op.Key, Status: http.StatusNoContent}
+			}
+			if err != nil {
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = &apiError{Code: codeInternal, Message: "cannot apply operation"}
+				break
+			}
+		}
+		return results, nil
+	}
+	err := tr.Transact(func(tx *datastore.Txn) error {
+		for i, op := range ops {
+			switch op.Op {
+			case "get":
+				val, err := tx.Get(raws[i])
+				results[i] = readResult(op, val, err)
+			case "put":
+				tx.Put(raws[i], op.Value)
+				results[i] = batchResult{Op: op.Op, Key: op.Key, Status: http.StatusOK}
+			case "delete":
+				tx.Delete(raws[i])
+				results[i] = batchResult{Op: op.Op, Key: op.Key, Status: http.StatusNoContent}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, newBatchError(http.StatusInternalServerError, codeInternal, "cannot apply batch")
+	}
+	return results, nil
+}
+
+func readResult(op batchOp, val string, err error) batchResult {
+	res := batchResult{Op: op.Op, Key: op.Key, Status: http.StatusOK}
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		res.Status = http.StatusNotFound
+		res.Error = &apiError{Code: codeNotFound, Message: err.Error()}
+	case err != nil:
+		res.Status = http.StatusInternalServerError
+		res.Error = &apiError{Code: codeInternal, Message: "cannot read value"}
+	default:
+		res.Value = val
+	}
+	return res
+}
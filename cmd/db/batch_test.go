@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/replication"
+)
+
+func TestBatchAPI(t *testing.T) {
+	h := setupDb(t)
+
+	do(t, h, http.MethodPut, "/db/old", `{"value":"1"}`)
+	do(t, h, http.MethodPut, "/buckets/users", "")
+
+	rec := do(t, h, http.MethodPost, "/db/_batch", `{"ops":[
+		{"op":"put","key":"a","value":"va"},
+		{"op":"put","key":"users/alice","value":"admin"},
+		{"op":"delete","key":"old"},
+		{"op":"get","key":"a"},
+		{"op":"get","key":"users/alice"},
+		{"op":"get","key":"old"}
+	]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d (%s)", rec.Code, rec.Body)
+	}
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		status int
+		value  string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusOK, ""},
+		{http.StatusNoContent, ""},
+		{http.StatusOK, "va"},
+		{http.StatusOK, "admin"},
+		{http.StatusNotFound, ""},
+	}
+	if len(body.Results) != len(expected) {
+		t.Fatalf("got %d results", len(body.Results))
+	}
+	for i, e := range expected {
+		if r := body.Results[i]; r.Status != e.status || r.Value != e.value {
+			t.Errorf("result %d: %+v", i, r)
+		}
+	}
+	if rec := do(t, h, http.MethodGet, "/db/users/alice", ""); rec.Code != http.StatusOK {
+		t.Errorf("bucket key written by the batch: %d", rec.Code)
+	}
+}
+
+func TestBatchAPI_Order(t *testing.T) {
+	h := setupDb(t)
+
+	do(t, h, http.MethodPut, "/db/k", `{"value":"old"}`)
+	rec := do(t, h, http.MethodPost, "/db/_batch", `{"ops":[
+		{"op":"get","key":"k"},
+		{"op":"put","key":"k","value":"new"},
+		{"op":"get","key":"k"},
+		{"op":"delete","key":"k"},
+		{"op":"get","key":"k"},
+		{"op":"put","key":"k","value":"last"}
+	]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d (%s)", rec.Code, rec.Body)
+	}
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	var reads []string
+	for _, r := range body.Results {
+		if r.Op == "get" {
+			reads = append(reads, fmt.Sprintf("%d:%s", r.Status, r.Value))
+		}
+	}
+	if got := strings.Join(reads, ","); got != "200:old,200:new,404:" {
+		t.Errorf("reads returned %s", got)
+	}
+	if rec := do(t, h, http.MethodGet, "/db/k", ""); !strings.Contains(rec.Body.String(), `"last"`) {
+		t.Errorf("GET after the batch: %s", rec.Body)
+	}
+}
+
+func TestBatchAPI_Rejected(t *testing.T) {
+	h := setupDb(t)
+
+	tooMany := make([]string, maxBatchOps+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf(`{"op":"get","key":"k%d"}`, i)
+	}
+	for _, s := range []struct{ body, code string }{
+		{`{"ops":[`, codeInvalidJSON},
+		{`{"ops":[{"op":"put","key":"a","value":"1"},{"op":"put","key":"b","value":""}]}`, codeEmptyValue},
+		{`{"ops":[{"op":"put","key":"a","value":"1"},{"op":"rename","key":"b"}]}`, codeBadRequest},
+		{`{"ops":[{"op":"put","key":"a","value":"1"},{"op":"get","key":""}]}`, codeInvalidKey},
+		{`{"ops":[` + strings.Join(tooMany, ",") + `]}`, codeBadRequest},
+	} {
+		rec := do(t, h, http.MethodPost, "/db/_batch", s.body)
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != s.code {
+			t.Errorf("status %d for %.60s", rec.Code, s.body)
+		}
+	}
+	if rec := do(t, h, http.MethodGet, "/db/a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("rejected batch was partially applied")
+	}
+	if rec := do(t, h, http.MethodGet, "/db/_batch", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /db/_batch: %d", rec.Code)
+	}
+
+	follower = replication.NewFollower("http://leader.invalid", primary)
+	rec := do(t, h, http.MethodPost, "/db/_batch", `{"ops":[{"op":"delete","key":"a"}]}`)
+	if rec.Code != http.StatusForbidden || errorCode(t, rec) != codeReadOnly {
+		t.Errorf("batch write on a follower: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/db/_batch", `{"ops":[{"op":"get","key":"a"}]}`); rec.Code != http.StatusOK {
+		t.Errorf("batch read on a follower: %d", rec.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+type keyValue interface {
+	Put(key, value string) error
+	Get(key string) (string, error)
+	Delete(key string) error
+}
+
+var (
+	errInvalidKey = errors.New("invalid key")
+	errNoBuckets  = errors.New("buckets require the log engine with a single shard")
+)
+
+// resolveKey maps /db/{bucket}/{key} onto a bucket when the first path
+// element names an existing bucket, and any other path onto a plain key.
+// Buckets are not created over plain keys starting with their name, so they
+// never hide one.
+func resolveKey(path string) (keyValue, string, error) {
+	if datastore.IsInternalKey(path) {
+		return nil, "", errInvalidKey
+	}
+	if primary != nil {
+		if name, key, ok := strings.Cut(path, "/"); ok {
+			if b, err := primary.Bucket(name); err == nil {
+				return b, key, nil
+			}
+		}
+	}
+	return db, path, nil
+}
+
+// hasPlainKeys tells whether plain keys start with "{name}/", which a bucket
+// called name would hide.
+func hasPlainKeys(name string) (bool, error) {
+	errFound := errors.New("found")
+	err := db.Scan(name+"/", func(string, string) error { return errFound })
+	if errors.Is(err, errFound) {
+		return true, nil
+	}
+	return false, err
+}
+
+// handleBuckets serves GET /buckets, and PUT and DELETE /buckets/{name}.
+func handleBuckets(w http.ResponseWriter, r *http.Request) {
+	if primary == nil {
+		writeError(w, http.StatusNotImplemented, errNoBuckets.Error())
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/buckets"), "/")
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"buckets": primary.Buckets()})
+		return
+	}
+
+	if follower != nil && r.Method != http.MethodGet {
+		writeError(w, http.StatusForbidden, "read-only follower")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		if found, err := hasPlainKeys(name); err != nil {
+			writeError(w, http.StatusInternalServerError, "cannot create bucket")
+			return
+		} else if found {
+			writeError(w, http.StatusConflict, fmt.Sprintf("plain keys start with %q", name+"/"))
+			return
+		}
+		switch err := primary.CreateBucket(name); {
+		case errors.Is(err, datastore.ErrBucketExists):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, datastore.ErrInvalidBucket):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "cannot create bucket")
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodDelete:
+		switch err := primary.DropBucket(name); {
+		case errors.Is(err, datastore.ErrBucketNotFound):
+			writeError(w, http.StatusNotFound, "not found")
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "cannot drop bucket")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodGet:
+		if _, err := primary.Bucket(name); err != nil {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// envPrefix prefixes the environment variable of every option, e.g.
+// DB_DATA_DIR for -data-dir.
+const envPrefix = "DB_"
+
+// config holds the options of the DB service. Each option is a flag, an
+// environment variable and a key of the JSON config file, which take
+// precedence in that order over the defaults.
+type config struct {
+	file  string
+	flags *flag.FlagSet
+
+	DataDir          string
+	ListenAddr       string
+	GRPCAddr         string
+	RESPAddr         string
+	Leader           string
+	Engine           string
+	Shards           int
+	IndexMode        string
+	BloomFPRate      float64
+	HotKeySampleRate float64
+	SegmentSize      byteSize
+	Sync             string
+	SyncInterval     time.Duration
+	MergeInterval    time.Duration
+	ShutdownTimeout  time.Duration
+	TLSCert          string
+	TLSKey           string
+	TLSClientCA      string
+	LeaderCA         string
+	AuthToken        string
+	AdminToken       string
+	TokensFile       string
+
+	tokens []*principal
+}
+
+// secretOptions are not printed with the effective config.
+var secretOptions = map[string]bool{"auth-token": true, "admin-token": true}
+
+var conf = &config{}
+
+func (c *config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	c.flags = fs
+	fs.StringVar(&c.file, "config", "", "path of a JSON config file with options keyed by flag name")
+	fs.StringVar(&c.DataDir, "data-dir", "./data", "directory of the datastore files")
+	fs.StringVar(&c.ListenAddr, "listen-addr", ":8083", "address of the HTTP API")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", ":8084", "address of the gRPC API; empty disables it")
+	fs.StringVar(&c.RESPAddr, "resp-addr", "", "address of the Redis protocol front-end, e.g. :6379; empty disables it")
+	fs.StringVar(&c.Leader, "leader", "", "URL of the leader DB service; when set the service runs as a read-only follower")
+	fs.StringVar(&c.Engine, "engine", "log", "storage engine: log (log-structured hash) or lsm (memtable + SSTables)")
+	fs.IntVar(&c.Shards, "shards", 1, "number of hash-partitioned datastore shards")
+	fs.StringVar(&c.IndexMode, "index", "hash", "datastore index mode: hash or sparse (memory-bounded)")
+	fs.Float64Var(&c.BloomFPRate, "bloom-fp-rate", datastore.DefaultBloomFalsePositiveRate, "target false positive rate of the per-segment bloom filters of the sparse index mode and the lsm engine")
+	fs.Float64Var(&c.HotKeySampleRate, "hotkeys-sample-rate", 0, "fraction of reads and writes sampled for /admin/hotkeys; 0 disables sampling")
+	c.SegmentSize = datastore.DefaultMaxSegmentSize
+	fs.Var(&c.SegmentSize, "segment-size", "size at which the active data file is closed as a segment, in bytes or with a KiB, MiB or GiB suffix")
+	fs.StringVar(&c.Sync, "sync", "none", "when writes are flushed to disk: none (by the OS), always (before acknowledging) or interval")
+	fs.DurationVar(&c.SyncInterval, "sync-interval", time.Second, "flush period of the interval sync policy")
+	fs.DurationVar(&c.MergeInterval, "merge-interval", 0, "period of background segment merges; 0 disables them")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long requests in progress may run on shutdown before they are dropped")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "certificate file; with -tls-key all APIs are served over TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "private key file of -tls-cert")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "CA certificates file; when set all APIs require client certificates signed by it")
+	fs.StringVar(&c.LeaderCA, "leader-ca", "", "CA certificates file verifying an https leader instead of the system roots; followers present -tls-cert to it")
+	fs.StringVar(&c.AuthToken, "auth-token", "", "bearer token required by all APIs and sent to the leader by followers; empty disables authentication")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "bearer token required by the /admin endpoints instead of -auth-token; empty leaves them to -auth-token")
+	fs.StringVar(&c.TokensFile, "tokens-file", "", "JSON file listing tokens with their allowed key prefixes and operations (read, write, admin)")
+	return fs
+}
+
+// loadConfig builds the config from the defaults, the config file, the
+// environment and the command line arguments.
+func loadConfig(name string, args []string, output io.Writer) (*config, error) {
+	c := &config{}
+	fs := c.flagSet(name)
+	fs.SetOutput(output)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := c.file
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := c.loadFile(fs, path); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		env := envName(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q of %s: %w", v, env, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	// Flags are parsed again to take precedence over the file and the
+	// environment.
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.file = path
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.TokensFile != "" {
+		tokens, err := loadTokens(c.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		c.tokens = tokens
+	}
+	return c, nil
+}
+
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+func (c *config) loadFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+	var options map[string]any
+	if err := json.Unmarshal(data, &options); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	for name, v := range options {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q in config file %s", name, path)
+		}
+		value := fmt.Sprint(v)
+		if f, ok := v.(float64); ok {
+			// Large integers must not be printed in exponent notation.
+			value = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value of %q in config file %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+func (c *config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.DataDir != "", "data-dir must not be empty")
+	addrs := map[string]string{}
+	for _, a := range []struct{ name, addr string }{
+		{"listen-addr", c.ListenAddr},
+		{"grpc-addr", c.GRPCAddr},
+		{"resp-addr", c.RESPAddr},
+	} {
+		if a.addr == "" {
+			check(a.name != "listen-addr", "listen-addr must not be empty")
+			continue
+		}
+		_, port, err := net.SplitHostPort(a.addr)
+		check(err == nil, "invalid %s %q", a.name, a.addr)
+		if other, ok := addrs[port]; ok && err == nil {
+			check(false, "%s and %s use the same port %s", other, a.name, port)
+		}
+		addrs[port] = a.name
+	}
+
+	check(c.Engine == "log" || c.Engine == "lsm", "unknown storage engine %q", c.Engine)
+	check(c.IndexMode == "hash" || c.IndexMode == "sparse", "unknown index mode %q", c.IndexMode)
+	check(c.Shards >= 1, "shards must be at least 1")
+	check(c.Leader == "" || (c.Engine == "log" && c.Shards == 1), "follower mode requires the log engine with a single shard")
+	check(c.BloomFPRate > 0 && c.BloomFPRate < 1, "bloom-fp-rate must be between 0 and 1")
+	check(c.HotKeySampleRate >= 0 && c.HotKeySampleRate <= 1, "hotkeys-sample-rate must be between 0 and 1")
+	check(c.SegmentSize > 0, "segment-size must be positive")
+
+	_, err := c.syncPolicy()
+	check(err == nil, "unknown sync policy %q", c.Sync)
+	check(c.Sync != "interval" || c.SyncInterval > 0, "sync-interval must be positive")
+	check(c.Sync == "none" || c.Engine == "log", "sync policies require the log engine")
+	check(c.MergeInterval >= 0, "merge-interval must not be negative")
+	check(c.MergeInterval == 0 || c.Engine == "log", "merge-interval requires the log engine")
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive")
+
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert and tls-key must be set together")
+	check(c.TLSClientCA == "" || c.TLSCert != "", "tls-client-ca requires tls-cert")
+	check(c.LeaderCA == "" || c.Leader != "", "leader-ca requires leader")
+	for _, file := range []string{c.TLSCert, c.TLSKey, c.TLSClientCA, c.LeaderCA, c.TokensFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "%v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *config) syncPolicy() (datastore.SyncPolicy, error) {
+	switch c.Sync {
+	case "none":
+		return datastore.SyncNone, nil
+	case "always":
+		return datastore.SyncAlways, nil
+	case "interval":
+		return datastore.SyncInterval, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy %q", c.Sync)
+}
+
+// tlsConfig loads the server certificate and the CA of client
+// certificates, returning nil when TLS is off.
+func (c *config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.TLSClientCA != "" {
+		if cfg.ClientCAs, err = loadCertPool(c.TLSClientCA); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// leaderTLSConfig configures the connections of a follower to its leader,
+// returning nil for the defaults.
+func (c *config) leaderTLSConfig() (*tls.Config, error) {
+	if c.LeaderCA == "" && c.TLSCert == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if c.LeaderCA != "" {
+		if cfg.RootCAs, err = loadCertPool(c.LeaderCA); err != nil {
+			return nil, err
+		}
+	}
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+func (c *config) options() datastore.Options {
+	opts := datastore.Options{
+		HotKeySampleRate:       c.HotKeySampleRate,
+		SyncInterval:           c.SyncInterval,
+		BloomFalsePositiveRate: c.BloomFPRate,
+	}
+	if c.IndexMode == "sparse" {
+		opts.IndexMode = datastore.SparseIndexMode
+	}
+	opts.Sync, _ = c.syncPolicy()
+	return opts
+}
+
+// print writes the effective value of every option with secrets redacted.
+func (c *config) print(w io.Writer) {
+	if c.file != "" {
+		fmt.Fprintf(w, "Config file: %s\n", c.file)
+	}
+	fmt.Fprintln(w, "Effective config:")
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.String()
+		if secretOptions[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(w, "  %-20s %q\n", f.Name, value)
+	})
+}
+
+// byteSize is a size in bytes that may be given with a binary unit suffix.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+func (s *byteSize) Set(v string) error {
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if n, ok := strings.CutSuffix(v, u.suffix); ok {
+			v, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return errors.New("invalid size")
+	}
+	*s = byteSize(n * unit)
+	return nil
+}
+
+func (s *byteSize) String() string {
+	for _, u := range byteUnits {
+		if *s != 0 && int64(*s)%u.size == 0 {
+			return fmt.Sprintf("%d%s", int64(*s)/u.size, u.suffix)
+		}
+	}
+	return "0"
+}
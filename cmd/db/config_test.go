@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	err := os.WriteFile(path, []byte(`{
+		"data-dir": "/from/file",
+		"listen-addr": ":9000",
+		"segment-size": "64MiB",
+		"shards": 4,
+		"sync": "interval"
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DB_CONFIG", path)
+	t.Setenv("DB_LISTEN_ADDR", ":9001")
+	t.Setenv("DB_SHARDS", "2")
+
+	c, err := loadConfig("db", []string{"-shards", "3", "-sync-interval", "250ms"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DataDir != "/from/file" || c.ListenAddr != ":9001" || c.Shards != 3 {
+		t.Errorf("wrong precedence: data-dir %q, listen-addr %q, shards %d", c.DataDir, c.ListenAddr, c.Shards)
+	}
+	if c.SegmentSize != 64<<20 || c.GRPCAddr != ":8084" {
+		t.Errorf("segment-size %d, grpc-addr %q", c.SegmentSize, c.GRPCAddr)
+	}
+	if opts := c.options(); opts.Sync != datastore.SyncInterval || opts.SyncInterval != 250*time.Millisecond {
+		t.Errorf("datastore options %+v", opts)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	for _, s := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-engine", "btree"}, "unknown storage engine"},
+		{[]string{"-engine", "lsm", "-merge-interval", "1m"}, "merge-interval requires the log engine"},
+		{[]string{"-sync", "sometimes"}, "unknown sync policy"},
+		{[]string{"-segment-size", "0"}, "segment-size must be positive"},
+		{[]string{"-grpc-addr", ":8083"}, "listen-addr and grpc-addr use the same port"},
+		{[]string{"-tls-cert", "cert.pem"}, "tls-cert and tls-key must be set together"},
+		{[]string{"-leader", "http://db:8083", "-shards", "2"}, "follower mode requires"},
+		{[]string{"-segment-size", "10MB"}, "invalid size"},
+		{[]string{"-tokens-file", "missing.json"}, "no such file"},
+		{[]string{"-tls-client-ca", "ca.pem"}, "tls-client-ca requires tls-cert"},
+		{[]string{"-leader-ca", "ca.pem"}, "leader-ca requires leader"},
+	} {
+		_, err := loadConfig("db", s.args, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), s.expected) {
+			t.Errorf("%v: got %v, expected %q", s.args, err, s.expected)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(path, []byte(`{"data_dir": "x"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig("db", []string{"-config", path}, io.Discard); err == nil || !strings.Contains(err.Error(), "unknown option") {
+		t.Errorf("unknown option in the config file: %v", err)
+	}
+}
+
+func TestConfig_Print(t *testing.T) {
+	c, err := loadConfig("db", []string{"-auth-token", "s3cret", "-segment-size", "1048576"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	c.print(&out)
+	if strings.Contains(out.String(), "s3cret") {
+		t.Error("printed config contains the auth token")
+	}
+	for _, line := range []string{`auth-token           "<redacted>"`, `segment-size         "1MiB"`, `data-dir             "./data"`} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("printed config has no %q:\n%s", line, out.String())
+		}
+	}
+}
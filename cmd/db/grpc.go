@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/dbrpc"
+)
+
+// grpcServer serves the gRPC API on the same datastore and with the same
+// rules as the HTTP one.
+type grpcServer struct {
+	dbrpc.UnimplementedDbServer
+}
+
+// newGRPCServer creates the gRPC server, serving over TLS when tlsConfig is
+// not nil.
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	dbrpc.RegisterDbServer(s, grpcServer{})
+	return s
+}
+
+var errReadOnly = status.Error(codes.FailedPrecondition, "read-only follower")
+
+// grpcResolveKey resolves a key as resolveKey does after authorizing op on
+// it.
+func grpcResolveKey(ctx context.Context, op, path string) (keyValue, string, error) {
+	target, key, err := resolveKey(path)
+	if err != nil {
+		return nil, "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	if key == "" {
+		return nil, "", status.Error(codes.InvalidArgument, "empty key")
+	}
+	if !callerFrom(ctx).authorize(op, path) {
+		return nil, "", errPermissionDenied
+	}
+	return target, key, nil
+}
+
+func (grpcServer) Get(ctx context.Context, req *dbrpc.GetRequest) (*dbrpc.GetResponse, error) {
+	target, key, err := grpcResolveKey(ctx, opRead, req.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	val, err := target.Get(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "cannot read value")
+	}
+	return &dbrpc.GetResponse{Value: val}, nil
+}
+
+func (grpcServer) Put(ctx context.Context, req *dbrpc.PutRequest) (*dbrpc.PutResponse, error) {
+	if follower != nil {
+		return nil, errReadOnly
+	}
+	target, key, err := grpcResolveKey(ctx, opWrite, req.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetValue() == "" {
+		return nil, status.Error(codes.InvalidArgument, "value must not be empty, use Delete to remove a key")
+	}
+	found, err := swap(target, key, req.GetValue(), "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, "cannot save value")
+	}
+	return &dbrpc.PutResponse{Created: !found}, nil
+}
+
+func (grpcServer) Delete(ctx context.Context, req *dbrpc.DeleteRequest) (*dbrpc.DeleteResponse, error) {
+	if follower != nil {
+		return nil, errReadOnly
+	}
+	target, key, err := grpcResolveKey(ctx, opWrite, req.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	found, err := swap(target, key, "", "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, "cannot delete value")
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, datastore.ErrNotFound.Error())
+	}
+	return &dbrpc.DeleteResponse{}, nil
+}
+
+var batchOpNames = map[dbrpc.BatchOp_Type]string{
+	dbrpc.BatchOp_TYPE_GET:    "get",
+	dbrpc.BatchOp_TYPE_PUT:    "put",
+	dbrpc.BatchOp_TYPE_DELETE: "delete",
+}
+
+var batchErrorCodes = map[int]codes.Code{
+	http.StatusBadRequest:     codes.InvalidArgument,
+	http.StatusForbidden:      codes.FailedPrecondition,
+	http.StatusNotImplemented: codes.Unimplemented,
+}
+
+func (grpcServer) Batch(ctx context.Context, req *dbrpc.BatchRequest) (*dbrpc.BatchResponse, error) {
+	ops := make([]batchOp, len(req.GetOps()))
+	for i, op := range req.GetOps() {
+		name, ok := batchOpNames[op.GetType()]
+		if !ok {
+			name = op.GetType().String()
+		}
+		ops[i] = batchOp{Op: name, Key: op.GetKey(), Value: op.GetValue()}
+	}
+
+	results, berr := runBatch(callerFrom(ctx), ops)
+	if berr != nil {
+		code, ok := batchErrorCodes[berr.status]
+		if berr.Code == codeForbidden {
+			code = codes.PermissionDenied
+		} else if !ok {
+			code = codes.Internal
+		}
+		return nil, status.Error(code, berr.Message)
+	}
+
+	resp := &dbrpc.BatchResponse{Results: make([]*dbrpc.BatchResult, len(results))}
+	for i, res := range results {
+		if res.Status == http.StatusInternalServerError {
+			return nil, status.Error(codes.Internal, res.Error.Message)
+		}
+		resp.Results[i] = &dbrpc.BatchResult{
+			Found: ops[i].Op == "get" && res.Status == http.StatusOK,
+			Value: res.Value,
+		}
+	}
+	return resp, nil
+}
+
+func (grpcServer) Scan(req *dbrpc.ScanRequest, stream grpc.ServerStreamingServer[dbrpc.KeyValue]) error {
+	c := callerFrom(stream.Context())
+	if !c.can(opRead) {
+		c.deny(opRead, req.GetPrefix())
+		return errPermissionDenied
+	}
+	err := db.Scan(req.GetPrefix(), func(key, value string) error {
+		if datastore.IsInternalKey(key) || !c.permits(opRead, key) {
+			return nil
+		}
+		return stream.Send(&dbrpc.KeyValue{Key: key, Value: value})
+	})
+	if _, ok := status.FromError(err); err != nil && !ok {
+		return status.Error(codes.Internal, "cannot scan keys")
+	}
+	return err
+}
+
+var eventTypes = map[datastore.EventType]dbrpc.Event_Type{
+	datastore.EventPut:    dbrpc.Event_TYPE_PUT,
+	datastore.EventDelete: dbrpc.Event_TYPE_DELETE,
+}
+
+func (grpcServer) Watch(req *dbrpc.WatchRequest, stream grpc.ServerStreamingServer[dbrpc.Event]) error {
+	if primary == nil {
+		return status.Error(codes.Unimplemented, "watch requires the log engine with a single shard")
+	}
+	c := callerFrom(stream.Context())
+	if !c.can(opRead) {
+		c.deny(opRead, req.GetPrefix())
+		return errPermissionDenied
+	}
+	after := primary.LastSeq()
+	if req.After != nil {
+		after = req.GetAfter()
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	defer context.AfterFunc(serverCtx, cancel)()
+	events, err := primary.Watch(ctx, req.GetPrefix(), after)
+	if errors.Is(err, datastore.ErrWatchPositionLost) {
+		return status.Error(codes.OutOfRange, err.Error())
+	} else if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	for ev := range events {
+		if datastore.IsInternalKey(ev.Key) || !c.permits(opRead, ev.Key) {
+			continue
+		}
+		msg := &dbrpc.Event{
+			Seq:         ev.Seq,
+			Type:        eventTypes[ev.Type],
+			Key:         ev.Key,
+			ContentType: ev.ContentType,
+		}
+		if utf8.ValidString(ev.Value) {
+			msg.Value = ev.Value
+		} else {
+			msg.Data = []byte(ev.Value)
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+	return stream.Context().Err()
+}
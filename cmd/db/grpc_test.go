@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbrpc"
+	"github.com/roman-mazur/architecture-practice-4-template/replication"
+)
+
+// setupGRPC serves the gRPC API on a local listener and returns a client.
+func setupGRPC(t *testing.T) dbrpc.DbClient {
+	t.Helper()
+	setupDb(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGRPCServer(nil)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return dbrpc.NewDbClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	c := setupGRPC(t)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, &dbrpc.GetRequest{Key: "k"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get of a missing key: %v", err)
+	}
+	if resp, err := c.Put(ctx, &dbrpc.PutRequest{Key: "k", Value: "v1"}); err != nil || !resp.Created {
+		t.Fatalf("Put = (%v, %v)", resp, err)
+	}
+	if resp, err := c.Put(ctx, &dbrpc.PutRequest{Key: "k", Value: "v2"}); err != nil || resp.Created {
+		t.Fatalf("replacing Put = (%v, %v)", resp, err)
+	}
+	if resp, err := c.Get(ctx, &dbrpc.GetRequest{Key: "k"}); err != nil || resp.Value != "v2" {
+		t.Errorf("Get = (%v, %v)", resp, err)
+	}
+	if _, err := c.Put(ctx, &dbrpc.PutRequest{Key: "k", Value: ""}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Put of an empty value: %v", err)
+	}
+	if _, err := c.Delete(ctx, &dbrpc.DeleteRequest{Key: "k"}); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if _, err := c.Delete(ctx, &dbrpc.DeleteRequest{Key: "k"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	resp, err := c.Batch(ctx, &dbrpc.BatchRequest{Ops: []*dbrpc.BatchOp{
+		{Type: dbrpc.BatchOp_TYPE_PUT, Key: "a", Value: "1"},
+		{Type: dbrpc.BatchOp_TYPE_PUT, Key: "b", Value: "2"},
+		{Type: dbrpc.BatchOp_TYPE_GET, Key: "a"},
+		{Type: dbrpc.BatchOp_TYPE_GET, Key: "missing"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := resp.Results; len(r) != 4 || !r[2].Found || r[2].Value != "1" || r[3].Found {
+		t.Errorf("Batch results %v", r)
+	}
+	_, err = c.Batch(ctx, &dbrpc.BatchRequest{Ops: []*dbrpc.BatchOp{{Key: "a"}}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Batch with an unspecified operation: %v", err)
+	}
+
+	stream, err := c.Scan(ctx, &dbrpc.ScanRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		kv, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, kv.Key)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("Scan returned %v", keys)
+	}
+}
+
+func TestGRPC_Watch(t *testing.T) {
+	c := setupGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Put(ctx, &dbrpc.PutRequest{Key: "old", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := c.Watch(ctx, &dbrpc.WatchRequest{Prefix: "user:", After: proto.Uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(ctx, &dbrpc.PutRequest{Key: "user:1", Value: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Delete(ctx, &dbrpc.DeleteRequest{Key: "user:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.PutTyped("user:2", "\x00\xff", "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []dbrpc.Event_Type{dbrpc.Event_TYPE_PUT, dbrpc.Event_TYPE_DELETE} {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != expected || ev.Key != "user:1" || ev.Seq == 0 {
+			t.Errorf("unexpected event %v", ev)
+		}
+	}
+	ev, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Value != "" || string(ev.Data) != "\x00\xff" || ev.ContentType != "application/octet-stream" {
+		t.Errorf("binary value event %v", ev)
+	}
+}
+
+func TestGRPC_Follower(t *testing.T) {
+	c := setupGRPC(t)
+	follower = replication.NewFollower("http://leader.invalid", primary)
+	ctx := context.Background()
+
+	if _, err := c.Put(ctx, &dbrpc.PutRequest{Key: "k", Value: "v"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Put on a follower: %v", err)
+	}
+	if _, err := c.Delete(ctx, &dbrpc.DeleteRequest{Key: "k"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Delete on a follower: %v", err)
+	}
+	_, err := c.Batch(ctx, &dbrpc.BatchRequest{Ops: []*dbrpc.BatchOp{{Type: dbrpc.BatchOp_TYPE_DELETE, Key: "k"}}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Batch write on a follower: %v", err)
+	}
+	if _, err := c.Get(ctx, &dbrpc.GetRequest{Key: "k"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get on a follower: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const readyCheckTimeout = 2 * time.Second
+
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleHealth reports that the process is alive, even while the datastore
+// is being recovered.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether requests can be served: the datastore is
+// open, its writer accepts requests, the data directory is writable and a
+// follower has bootstrapped from its leader.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"datastore": "ok"}
+	ready := serverCtx.Err() == nil
+	if !ready {
+		checks["datastore"] = "shutting down"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+	if p, ok := db.(datastore.Pinger); ok {
+		checks["writer"] = "ok"
+		if err := p.Ping(ctx); err != nil {
+			checks["writer"], ready = err.Error(), false
+		}
+	}
+	checks["disk"] = "ok"
+	if err := checkWritable(conf.DataDir); err != nil {
+		checks["disk"], ready = err.Error(), false
+	}
+	if follower != nil {
+		checks["replication"] = "ok"
+		if !follower.Status().Bootstrapped {
+			checks["replication"], ready = "bootstrapping", false
+		}
+	}
+
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, readiness{Status: "not ready", Checks: checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, readiness{Status: "ready", Checks: checks})
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".ready-*")
+	if err != nil {
+		return fmt.Errorf("data directory is not writable: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("data directory is not writable: %w", err)
+	}
+	return nil
+}
+
+// startupHandler answers health checks while the datastore is being opened
+// and hands every request to the API once it is.
+type startupHandler struct {
+	api atomic.Pointer[http.Handler]
+}
+
+func (h *startupHandler) open(api http.Handler) {
+	h.api.Store(&api)
+}
+
+func (h *startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if api := h.api.Load(); api != nil {
+		(*api).ServeHTTP(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/health":
+		handleHealth(w, r)
+	case "/ready":
+		writeJSON(w, http.StatusServiceUnavailable, readiness{
+			Status: "not ready",
+			Checks: map[string]string{"datastore": "recovering"},
+		})
+	default:
+		writeError(w, http.StatusServiceUnavailable, "datastore is being recovered")
+	}
+}
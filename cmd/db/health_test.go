@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/replication"
+)
+
+func readyChecks(t *testing.T, rec *httptest.ResponseRecorder) readiness {
+	t.Helper()
+	var body readiness
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestHealth(t *testing.T) {
+	h := setupDb(t)
+	conf = &config{DataDir: t.TempDir()}
+	t.Cleanup(func() { conf = &config{} })
+
+	if rec := do(t, h, http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("health: %d", rec.Code)
+	}
+	rec := do(t, h, http.MethodGet, "/ready", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ready: %d (%s)", rec.Code, rec.Body)
+	}
+	if body := readyChecks(t, rec); body.Checks["writer"] != "ok" || body.Checks["disk"] != "ok" {
+		t.Errorf("ready checks: %v", body.Checks)
+	}
+
+	conf.DataDir = filepath.Join(t.TempDir(), "missing")
+	rec = do(t, h, http.MethodGet, "/ready", "")
+	if rec.Code != http.StatusServiceUnavailable || readyChecks(t, rec).Checks["disk"] == "ok" {
+		t.Errorf("ready with an unwritable data dir: %d", rec.Code)
+	}
+	conf.DataDir = t.TempDir()
+
+	follower = replication.NewFollower("http://leader.invalid", primary)
+	rec = do(t, h, http.MethodGet, "/ready", "")
+	if rec.Code != http.StatusServiceUnavailable || readyChecks(t, rec).Checks["replication"] != "bootstrapping" {
+		t.Errorf("ready before the follower bootstrapped: %d", rec.Code)
+	}
+	follower = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serverCtx = ctx
+	t.Cleanup(func() { serverCtx = context.Background() })
+	cancel()
+	if rec := do(t, h, http.MethodGet, "/ready", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready while shutting down: %d", rec.Code)
+	}
+}
+
+func TestHealth_Startup(t *testing.T) {
+	h := &startupHandler{}
+
+	if rec := do(t, h, http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("health while starting: %d", rec.Code)
+	}
+	for _, path := range []string{"/ready", "/db/k"} {
+		if rec := do(t, h, http.MethodGet, path, ""); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s while starting: %d", path, rec.Code)
+		}
+	}
+
+	h.open(setupDb(t))
+	if rec := do(t, h, http.MethodGet, "/db/k", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("API after opening: %d", rec.Code)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	h := setupDb(t)
+
+	for _, key := range []string{"a", "b", "a"} {
+		do(t, h, http.MethodPut, "/db/"+key, `{"value":"v"}`)
+	}
+
+	rec := do(t, h, http.MethodGet, "/admin/stats", "")
+	var stats struct{ Keys int }
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || rec.Code != http.StatusOK || stats.Keys != 2 {
+		t.Errorf("stats: %d, %+v, %v", rec.Code, stats, err)
+	}
+
+	rec = do(t, h, http.MethodGet, "/admin/segments", "")
+	var segments struct {
+		Active   map[string]any
+		Segments []map[string]any
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&segments); err != nil || segments.Active == nil {
+		t.Errorf("segments: %d, %v", rec.Code, err)
+	}
+
+	if rec := do(t, h, http.MethodGet, "/admin/merge", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET merge: %d", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/admin/merge", ""); rec.Code != http.StatusOK {
+		t.Errorf("merge: %d (%s)", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, http.MethodGet, "/db/a", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET after merge: %d", rec.Code)
+	}
+}
+
+func TestMergeSchedule(t *testing.T) {
+	saved := datastore.MaxSegmentSize
+	datastore.MaxSegmentSize = 300
+	t.Cleanup(func() { datastore.MaxSegmentSize = saved })
+	h := setupDb(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runMergeSchedule(ctx, time.Millisecond)
+		close(done)
+	}()
+	for i := 0; i < 200; i++ {
+		if rec := do(t, h, http.MethodPut, fmt.Sprintf("/db/k%03d", i), `{"value":"v"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("PUT during scheduled merges: %d (%s)", rec.Code, rec.Body)
+		}
+	}
+	cancel()
+	<-done
+
+	if primary.Stats().Merges == 0 {
+		t.Error("no scheduled merge ran")
+	}
+	for i := 0; i < 200; i++ {
+		if rec := do(t, h, http.MethodGet, fmt.Sprintf("/db/k%03d", i), ""); rec.Code != http.StatusOK {
+			t.Fatalf("k%03d lost by scheduled merges: %d", i, rec.Code)
+		}
+	}
+}
+
+func TestAdmin_Token(t *testing.T) {
+	h := setupDb(t)
+	conf = &config{DataDir: t.TempDir(), AuthToken: "user", AdminToken: "admin"}
+	t.Cleanup(func() { conf = &config{} })
+
+	steps := []struct {
+		path, token string
+		status      int
+	}{
+		{"/health", "", http.StatusOK},
+		{"/ready", "", http.StatusOK},
+		{"/db/k", "user", http.StatusNotFound},
+		{"/db/k", "admin", http.StatusForbidden},
+		{"/admin/stats", "user", http.StatusForbidden},
+		{"/admin/stats", "wrong", http.StatusUnauthorized},
+		{"/admin/stats", "admin", http.StatusOK},
+	}
+	for _, s := range steps {
+		req := httptest.NewRequest(http.MethodGet, s.path, nil)
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != s.status {
+			t.Errorf("%s with token %q: status %d, expected %d", s.path, s.token, rec.Code, s.status)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const indexPath = "/db/_index/"
+
+// handleIndexes serves GET /db/_index/ (definitions), GET
+// /db/_index/{name}?value= (lookups), and PUT ?path= and DELETE
+// /db/_index/{name}.
+func handleIndexes(w http.ResponseWriter, r *http.Request) {
+	if primary == nil {
+		writeError(w, http.StatusNotImplemented, "indexes require the log engine with a single shard")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, indexPath)
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]map[string]string{"indexes": primary.Indexes()})
+		return
+	}
+
+	if follower != nil && r.Method != http.MethodGet {
+		writeError(w, http.StatusForbidden, "read-only follower")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !r.URL.Query().Has("value") {
+			writeError(w, http.StatusBadRequest, "missing value parameter")
+			return
+		}
+		res, err := primary.FindBy(name, r.URL.Query().Get("value"))
+		if errors.Is(err, datastore.ErrIndexNotFound) {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]datastore.KeyValue{"results": res})
+	case http.MethodPut, http.MethodPost:
+		switch err := primary.CreateIndex(name, r.URL.Query().Get("path")); {
+		case errors.Is(err, datastore.ErrIndexExists):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, datastore.ErrInvalidIndex):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "cannot create index")
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodDelete:
+		switch err := primary.DropIndex(name); {
+		case errors.Is(err, datastore.ErrIndexNotFound):
+			writeError(w, http.StatusNotFound, "not found")
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "cannot drop index")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
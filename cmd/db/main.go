@@ -1,68 +1,212 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/replication"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
 )
 
-const (
-	dbDir      = "./data"
-	listenAddr = ":8083"
+var (
+	db datastore.Store
+	// primary is the unsharded log-structured datastore; watch and
+	// replication are only available when the service runs on it.
+	primary  *datastore.Db
+	follower *replication.Follower
 )
 
-var db *datastore.Db
-
 func main() {
-	var err error
-	if err := os.MkdirAll(dbDir, 0o755); err != nil {
-		log.Fatalf("cannot create data dir: %v", err)
+	c, err := loadConfig(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	conf = c
+	var printed strings.Builder
+	conf.print(&printed)
+	log.Print(printed.String())
+
+	datastore.MaxSegmentSize = int64(conf.SegmentSize)
+	tlsConfig, err := conf.tlsConfig()
+	if err != nil {
+		log.Fatalf("cannot load TLS certificate: %v", err)
+	}
+	leaderTLS, err := conf.leaderTLSConfig()
+	if err != nil {
+		log.Fatalf("cannot load TLS certificates of the leader connection: %v", err)
+	}
+
+	// Listening first reports busy ports before the datastore is touched.
+	listeners := map[string]net.Listener{}
+	for name, addr := range map[string]string{"HTTP": conf.ListenAddr, "gRPC": conf.GRPCAddr, "RESP": conf.RESPAddr} {
+		if addr == "" {
+			continue
+		}
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("cannot listen for %s: %v", name, err)
+		}
+		if tlsConfig != nil && name != "gRPC" {
+			lis = tls.NewListener(lis, tlsConfig)
+		}
+		listeners[name] = lis
 	}
 
-	db, err = datastore.Open(dbDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	serverCtx = ctx
+	// The HTTP API answers health checks while the datastore recovers.
+	srv := newServers(tlsConfig)
+	srv.serveHTTP(listeners["HTTP"])
+
+	if err := os.MkdirAll(conf.DataDir, 0o755); err != nil {
+		log.Fatalf("cannot create data dir: %v", err)
+	}
+	opts := conf.options()
+	switch {
+	case conf.Engine == "lsm":
+		db, err = datastore.OpenLSMWithOptions(conf.DataDir, opts)
+	case conf.Shards > 1:
+		db, err = datastore.OpenSharded(conf.DataDir, conf.Shards, opts)
+	default:
+		primary, err = datastore.OpenWithOptions(conf.DataDir, opts)
+		db = primary
+	}
 	if err != nil {
 		log.Fatalf("failed to open DB: %v", err)
 	}
-	defer db.Close()
 
-	http.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Path[len("/db/"):]
-		switch r.Method {
-		case http.MethodGet:
-			val, err := db.Get(key)
-			if err == datastore.ErrNotFound {
-				http.NotFound(w, r)
-				return
-			} else if err != nil {
-				http.Error(w, "internal error", http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]string{
-				"key":   key,
-				"value": val,
-			})
-		case http.MethodPost:
-			var body struct {
-				Value string `json:"value"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-				http.Error(w, "invalid JSON", http.StatusBadRequest)
-				return
-			}
-			if err := db.Put(key, body.Value); err != nil {
-				http.Error(w, "cannot save", http.StatusInternalServerError)
-				return
+	var background sync.WaitGroup
+	if conf.Leader != "" {
+		follower = replication.NewFollower(conf.Leader, primary)
+		follower.SetAuthToken(conf.AuthToken)
+		if leaderTLS != nil {
+			follower.SetTLSConfig(leaderTLS)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			follower.Run(ctx)
+		}()
+		log.Printf("Following leader %s", conf.Leader)
+	}
+	if conf.MergeInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			runMergeSchedule(ctx, conf.MergeInterval)
+		}()
+	}
+
+	srv.api.open(newHandler())
+	if lis, ok := listeners["gRPC"]; ok {
+		srv.serveGRPC(lis)
+		log.Printf("gRPC API running on %s", conf.GRPCAddr)
+	}
+	if lis, ok := listeners["RESP"]; ok {
+		srv.serveRESP(lis)
+		log.Printf("Redis protocol front-end running on %s", conf.RESPAddr)
+	}
+	log.Printf("DB service running on %s with the %s engine", conf.ListenAddr, conf.Engine)
+
+	exitCode := 0
+	terminated := make(chan struct{})
+	go func() {
+		signal.WaitForTerminationSignal()
+		close(terminated)
+	}()
+	select {
+	case <-terminated:
+	case err := <-srv.errs:
+		log.Print(err)
+		exitCode = 1
+	}
+
+	// Writes in progress are completed and no new ones start before the
+	// datastore is closed, so no record is cut. Handlers still running after
+	// the timeout get datastore.ErrClosed.
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.shutdown(shutdownCtx); err != nil {
+		log.Printf("requests still running after %v were dropped: %v", conf.ShutdownTimeout, err)
+	}
+	background.Wait()
+	if err := db.Close(); err != nil {
+		log.Printf("cannot close the datastore: %v", err)
+		exitCode = 1
+	}
+	log.Print("DB service stopped")
+	os.Exit(exitCode)
+}
+
+// runMergeSchedule merges segments of the datastore every interval. Writes
+// go on during a merge, which only swaps the merged segment in between two
+// writes.
+func runMergeSchedule(ctx context.Context, interval time.Duration) {
+	m, ok := db.(interface{ MergeSegments() error })
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.MergeSegments(); err != nil {
+				log.Printf("scheduled merge failed: %v", err)
 			}
-			w.WriteHeader(http.StatusOK)
-		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	}
+}
 
-	log.Printf("DB service running on %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+// newHandler routes the DB service API to the datastore opened in main.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	if primary != nil {
+		mux.Handle("/replication/", replication.NewLeaderHandler(primary))
+		mux.HandleFunc("/replication/status", func(w http.ResponseWriter, r *http.Request) {
+			if follower == nil {
+				writeJSON(w, http.StatusOK, map[string]any{
+					"role": "leader",
+					"seq":  primary.LastSeq(),
+				})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"role":   "follower",
+				"status": follower.Status(),
+			})
+		})
+		mux.HandleFunc("/db/watch", handleWatch)
+	}
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
+	mux.HandleFunc("/buckets", handleBuckets)
+	mux.HandleFunc("/buckets/", handleBuckets)
+	mux.HandleFunc(indexPath, handleIndexes)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/admin/export", handleExport)
+	mux.HandleFunc("/admin/import", handleImport)
+	mux.HandleFunc("/admin/backup", handleBackup)
+	mux.HandleFunc("/admin/hotkeys", handleHotKeys)
+	mux.HandleFunc("/admin/merge", handleMerge)
+	mux.HandleFunc("/admin/stats", handleStats)
+	mux.HandleFunc("/admin/segments", handleSegments)
+	mux.HandleFunc(batchPath, handleBatch)
+	mux.HandleFunc("/db/", handleKey)
+	return requireToken(mux)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleMetrics serves datastore stats in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, db.Stats())
+}
+
+func writeMetrics(w io.Writer, st datastore.Stats) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("datastore_info", "gauge", "Storage engine and index mode of the datastore.")
+	fmt.Fprintf(w, "datastore_info{engine=%q,index_mode=%q} 1\n", st.Engine, st.IndexMode)
+
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"datastore_keys", "Number of live keys.", float64(st.Keys)},
+		{"datastore_segments", "Number of closed segments.", float64(st.SegmentCount)},
+		{"datastore_last_seq", "Sequence number of the latest record.", float64(st.LastSeq)},
+		{"datastore_write_queue_depth", "Write requests waiting for or being handled by the writer.", float64(st.WriteQueueDepth)},
+		{"datastore_last_merge_duration_seconds", "Duration of the last segment merge.", st.LastMergeDuration.Seconds()},
+		{"datastore_recovery_duration_seconds", "Time spent recovering the datastore on open.", st.RecoveryDuration.Seconds()},
+	}
+	for _, g := range gauges {
+		metric(g.name, "gauge", g.help)
+		fmt.Fprintf(w, "%s %g\n", g.name, g.value)
+	}
+
+	counters := []struct {
+		name, help string
+		value      float64
+	}{
+		{"datastore_reads_total", "Number of key lookups.", float64(st.Reads)},
+		{"datastore_writes_total", "Number of records written.", float64(st.Writes)},
+		{"datastore_merges_total", "Number of segment merges.", float64(st.Merges)},
+		{"datastore_merge_duration_seconds_total", "Total time spent merging segments.", st.MergeDuration.Seconds()},
+		{"datastore_bloom_negatives_total", "Segment lookups skipped thanks to bloom filters.", float64(st.BloomNegatives)},
+	}
+	for _, c := range counters {
+		metric(c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %g\n", c.name, c.value)
+	}
+
+	segments := st.Segments
+	if st.Active != nil {
+		segments = append(segments, *st.Active)
+	}
+	metric("datastore_segment_bytes", "gauge", "Bytes of data files by record state.")
+	for _, seg := range segments {
+		fmt.Fprintf(w, "datastore_segment_bytes{segment=%q,state=\"live\"} %d\n", seg.Name, seg.LiveBytes)
+		fmt.Fprintf(w, "datastore_segment_bytes{segment=%q,state=\"dead\"} %d\n", seg.Name, seg.DeadBytes)
+	}
+}
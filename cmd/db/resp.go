@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	maxRESPArgs     = 1 << 20
+	maxRESPBulkSize = 16 << 20
+	// maxRESPCommandSize limits the bytes of all arguments of a command.
+	maxRESPCommandSize = 64 << 20
+	defaultScanSize    = 10
+)
+
+// respLimits bound what a client may make the server read for one command.
+type respLimits struct {
+	args, bulkSize, commandSize int
+}
+
+var (
+	respAuthLimits = respLimits{args: maxRESPArgs, bulkSize: maxRESPBulkSize, commandSize: maxRESPCommandSize}
+	// Before AUTH a client only needs to send AUTH [username] password.
+	respNoAuthLimits = respLimits{args: 3, bulkSize: 4 << 10, commandSize: 8 << 10}
+)
+
+var (
+	errRESPProtocol = errors.New("protocol error")
+	errStopScan     = errors.New("stop scan")
+)
+
+// respError is sent to the client as a RESP error reply.
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+const (
+	errRESPSyntax   = respError("ERR syntax error")
+	errRESPInteger  = respError("ERR value is not an integer or out of range")
+	errRESPReadOnly = respError("READONLY You can't write against a read only replica.")
+	errRESPNoPerm   = respError("NOPERM this user has no permissions to access one of the keys used as arguments")
+)
+
+// respServer serves the Redis protocol and keeps track of its connections
+// for Shutdown.
+type respServer struct {
+	mu       sync.Mutex
+	lis      net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	handlers sync.WaitGroup
+}
+
+func newRESPServer() *respServer {
+	return &respServer{conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections until the server is shut down, then returns
+// net.ErrClosed.
+func (s *respServer) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		lis.Close()
+		return net.ErrClosed
+	}
+	s.lis = lis
+	s.mu.Unlock()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.handlers.Done()
+			handleRESPConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and lets the commands in progress
+// finish, closing every connection before reading its next command. When
+// ctx is done first, the remaining connections are closed.
+func (s *respServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.lis != nil {
+		s.lis.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	c := caller{api: "RESP", addr: conn.RemoteAddr().String()}
+	if !conf.authEnabled() {
+		c.principal = anonymous
+	}
+	for {
+		limits := respAuthLimits
+		if c.principal == nil {
+			limits = respNoAuthLimits
+		}
+		args, err := readRESPCommand(r, limits)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				writeRESP(w, respError("ERR "+err.Error()))
+				_ = w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("RESP connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(args[0])
+		var reply any
+		switch {
+		case name == "quit":
+			writeRESP(w, "OK")
+			_ = w.Flush()
+			return
+		case name == "auth":
+			reply = respAuth(args[1:], &c)
+		case c.principal == nil:
+			auditUnauthenticated("RESP", c.addr, name)
+			reply = respError("NOAUTH Authentication required.")
+		default:
+			reply = runRESPCommand(c, name, args[1:])
+		}
+		writeRESP(w, reply)
+		// Replies of pipelined commands are flushed together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings or as an
+// inline command.
+func readRESPCommand(r *bufio.Reader, limits respLimits) ([]string, error) {
+	line, err := readRESPLine(r, limits.commandSize)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > limits.args {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	// Arguments are only allocated as they arrive, so a large count alone
+	// does not reserve memory.
+	args := make([]string, 0, min(max(n, 0), 16))
+	total := 0
+	for range n {
+		line, err := readRESPLine(r, limits.commandSize)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > limits.bulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		if total += size; total > limits.commandSize {
+			return nil, fmt.Errorf("%w: command too large", errRESPProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line of at most limit bytes.
+func readRESPLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit+2 {
+			return "", fmt.Errorf("%w: too big request", errRESPProtocol)
+		}
+		line = append(line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// writeRESP encodes a reply: a string is sent as a simple string, a
+// *string as a bulk string or null when nil, and a slice as an array.
+func writeRESP(w *bufio.Writer, v any) {
+	switch v := v.(type) {
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case *string:
+		if v == nil {
+			w.WriteString("$-1\r\n")
+		} else {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(*v), *v)
+		}
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESP(w, item)
+		}
+	}
+}
+
+func bulk(s string) *string { return &s }
+
+func wrongArgs(name string) respError {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+// respAuth serves AUTH [username] password, with the password being the
+// bearer token of the other APIs. The username is ignored.
+func respAuth(args []string, c *caller) any {
+	if len(args) == 0 || len(args) > 2 {
+		return wrongArgs("auth")
+	}
+	if !conf.authEnabled() {
+		return respError("ERR AUTH called without any password configured")
+	}
+	p := conf.authenticate(args[len(args)-1])
+	if p == nil {
+		auditUnauthenticated("RESP", c.addr, "auth")
+		return respError("WRONGPASS invalid username-password pair")
+	}
+	c.principal = p
+	return "OK"
+}
+
+// respAuthorize checks op on every key of a command.
+func respAuthorize(c caller, op string, keys ...string) bool {
+	for _, key := range keys {
+		if !c.authorize(op, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// runRESPCommand executes a command on the datastore and returns its reply.
+// Keys are resolved and authorized as in the HTTP API, so "{bucket}/{key}"
+// addresses a key of an existing bucket.
+func runRESPCommand(c caller, name string, args []string) any {
+	switch name {
+	case "ping":
+		switch len(args) {
+		case 0:
+			return "PONG"
+		case 1:
+			return bulk(args[0])
+		}
+		return wrongArgs(name)
+	case "get":
+		if len(args) != 1 {
+			return wrongArgs(name)
+		}
+		reply := respMGet(c, args)
+		if values, ok := reply.([]any); ok {
+			return values[0]
+		}
+		return reply
+	case "mget":
+		if len(args) == 0 {
+			return wrongArgs(name)
+		}
+		return respMGet(c, args)
+	case "set":
+		if len(args) < 2 {
+			return wrongArgs(name)
+		}
+		if !c.authorize(opWrite, args[0]) {
+			return errRESPNoPerm
+		}
+		return respSet(args[0], args[1], args[2:])
+	case "mset":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return wrongArgs(name)
+		}
+		ops := make([]batchOp, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			ops = append(ops, batchOp{Op: "put", Key: args[i], Value: args[i+1]})
+		}
+		if _, err := respBatch(c, ops); err != nil {
+			return err
+		}
+		return "OK"
+	case "del", "exists":
+		if len(args) == 0 {
+			return wrongArgs(name)
+		}
+		return respDelExists(c, name, args)
+	case "incrby":
+		if len(args) != 2 {
+			return wrongArgs(name)
+		}
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errRESPInteger
+		}
+		if !c.authorize(opRead, args[0]) || !c.authorize(opWrite, args[0]) {
+			return errRESPNoPerm
+		}
+		return respIncrBy(args[0], delta)
+	case "scan":
+		if len(args) == 0 {
+			return wrongArgs(name)
+		}
+		return respScan(c, args)
+	}
+	return respError(fmt.Sprintf("ERR unknown command '%s'", name))
+}
+
+// respBatch runs operations through the batch API, so multi-key commands
+// follow its rules and are atomic where the store runs transactions. The
+// operation limit of HTTP batches does not apply.
+func respBatch(c caller, ops []batchOp) ([]batchResult, error) {
+	results, berr := evalBatch(c, ops, false)
+	if berr != nil {
+		switch berr.Code {
+		case codeForbidden:
+			return nil, errRESPNoPerm
+		case codeReadOnly:
+			return nil, errRESPReadOnly
+		case codeEmptyValue:
+			return nil, respError("ERR empty values are not supported")
+		}
+		return nil, respError("ERR " + berr.Message)
+	}
+	for _, res := range results {
+		if res.Status == http.StatusInternalServerError {
+			return nil, respError("ERR " + res.Error.Message)
+		}
+	}
+	return results, nil
+}
+
+func getOps(keys []string) []batchOp {
+	ops := make([]batchOp, len(keys))
+	for i, key := range keys {
+		ops[i] = batchOp{Op: "get", Key: key}
+	}
+	return ops
+}
+
+func respMGet(c caller, keys []string) any {
+	results, err := respBatch(c, getOps(keys))
+	if err != nil {
+		return err
+	}
+	reply := make([]any, len(keys))
+	for i, res := range results {
+		var value *string
+		if res.Error == nil {
+			value = bulk(res.Value)
+		}
+		reply[i] = value
+	}
+	return reply
+}
+
+func respSet(key, value string, opts []string) any {
+	var ttl time.Duration
+	for i := 0; i < len(opts); i++ {
+		var unit time.Duration
+		switch strings.ToLower(opts[i]) {
+		case "ex":
+			unit = time.Second
+		case "px":
+			unit = time.Millisecond
+		default:
+			return errRESPSyntax
+		}
+		if ttl != 0 || i+1 == len(opts) {
+			return errRESPSyntax
+		}
+		i++
+		n, err := strconv.ParseInt(opts[i], 10, 64)
+		if err != nil {
+			return errRESPInteger
+		}
+		if n <= 0 {
+			return respError("ERR invalid expire time in 'set' command")
+		}
+		ttl = time.Duration(n) * unit
+	}
+
+	if follower != nil {
+		return errRESPReadOnly
+	}
+	if value == "" {
+		return respError("ERR empty values are not supported")
+	}
+	target, key, err := resolveKey(key)
+	if err != nil || key == "" {
+		return respError("ERR invalid key")
+	}
+	if ttl == 0 {
+		err = target.Put(key, value)
+	} else if tw, ok := target.(datastore.TTLWriter); ok {
+		err = tw.PutTTL(key, value, ttl)
+	} else {
+		return respError("ERR expiration is not supported by the storage engine")
+	}
+	if err != nil {
+		return respError("ERR cannot save value")
+	}
+	return "OK"
+}
+
+func respDelExists(c caller, name string, keys []string) any {
+	if name == "del" && follower != nil {
+		return errRESPReadOnly
+	}
+	if name == "del" && !respAuthorize(c, opWrite, keys...) {
+		return errRESPNoPerm
+	}
+	if _, ok := db.(datastore.Transactor); name == "del" && !ok {
+		return respDelKeys(keys)
+	}
+	// DEL reads every key right before deleting it in the same batch, so
+	// the count covers the keys this command removed, each once.
+	ops := getOps(keys)
+	if name == "del" {
+		ops = make([]batchOp, 0, 2*len(keys))
+		for _, key := range keys {
+			ops = append(ops, batchOp{Op: "get", Key: key}, batchOp{Op: "delete", Key: key})
+		}
+	}
+	results, err := respBatch(c, ops)
+	if err != nil {
+		return err
+	}
+	var n int64
+	for _, res := range results {
+		if res.Op == "get" && res.Error == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// respDelKeys deletes keys one by one on stores without transactions,
+// counting the keys each delete found.
+func respDelKeys(paths []string) any {
+	targets := make([]keyValue, len(paths))
+	keys := make([]string, len(paths))
+	for i, path := range paths {
+		target, key, err := resolveKey(path)
+		if err != nil || key == "" {
+			return respError("ERR invalid key")
+		}
+		targets[i], keys[i] = target, key
+	}
+	var n int64
+	for i, key := range keys {
+		found, err := swap(targets[i], key, "", "")
+		if err != nil {
+			return respError("ERR cannot delete value")
+		}
+		if found {
+			n++
+		}
+	}
+	return n
+}
+
+func respIncrBy(key string, delta int64) any {
+	if follower != nil {
+		return errRESPReadOnly
+	}
+	target, key, err := resolveKey(key)
+	if err != nil || key == "" {
+		return respError("ERR invalid key")
+	}
+	var u datastore.Updater
+	if b, ok := target.(*datastore.Bucket); ok {
+		u, key = primary, b.RawKey(key)
+	} else if u, ok = target.(datastore.Updater); !ok {
+		return respError("ERR INCRBY is not supported by the storage engine")
+	}
+
+	var result int64
+	err = u.Update(key, func(value string, found bool) (string, error) {
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", errRESPInteger
+			}
+		}
+		if (delta > 0 && n > n+delta) || (delta < 0 && n < n+delta) {
+			return "", respError("ERR increment or decrement would overflow")
+		}
+		result = n + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+	var rerr respError
+	if errors.As(err, &rerr) {
+		return rerr
+	} else if err != nil {
+		return respError("ERR cannot save value")
+	}
+	return result
+}
+
+// respScan serves SCAN cursor [MATCH pattern] [COUNT count]. Keys are
+// visited in ascending order and the cursor is the number of keys already
+// visited, so keys deleted during the iteration may shift it past some keys.
+func respScan(c caller, args []string) any {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return respError("ERR invalid cursor")
+	}
+	count := uint64(defaultScanSize)
+	var pattern *regexp.Regexp
+	prefix := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errRESPSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			if prefix, pattern, err = compileGlob(args[i+1]); err != nil {
+				return respError("ERR invalid pattern")
+			}
+		case "count":
+			if count, err = strconv.ParseUint(args[i+1], 10, 64); err != nil || count == 0 {
+				return errRESPInteger
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+
+	if !c.can(opRead) {
+		c.deny(opRead, prefix)
+		return errRESPNoPerm
+	}
+	var visited uint64
+	keys := []any{}
+	err = db.Scan(prefix, func(key, _ string) error {
+		if datastore.IsInternalKey(key) || !c.permits(opRead, key) {
+			return nil
+		}
+		if visited == cursor+count {
+			return errStopScan
+		}
+		visited++
+		if visited > cursor && (pattern == nil || pattern.MatchString(key)) {
+			keys = append(keys, bulk(key))
+		}
+		return nil
+	})
+	next := uint64(0)
+	if errors.Is(err, errStopScan) {
+		next = visited
+	} else if err != nil {
+		return respError("ERR cannot scan keys")
+	}
+	return []any{bulk(strconv.FormatUint(next, 10)), keys}
+}
+
+// compileGlob converts a Redis glob pattern into a regexp and returns its
+// literal prefix, which narrows the scan.
+func compileGlob(pattern string) (string, *regexp.Regexp, error) {
+	var prefix, expr strings.Builder
+	literal := true
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*':
+			expr.WriteString(".*")
+		case c == '?':
+			expr.WriteString(".")
+		case c == '[' && strings.IndexByte(pattern[i+1:], ']') > 0:
+			end := i + 1 + strings.IndexByte(pattern[i+1:], ']')
+			class := pattern[i+1 : end]
+			if negated, ok := strings.CutPrefix(class, "^"); ok {
+				class = "^" + regexp.QuoteMeta(negated)
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			expr.WriteString("[" + class + "]")
+			i = end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			c = pattern[i]
+			fallthrough
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+			if literal {
+				prefix.WriteByte(c)
+			}
+			continue
+		}
+		literal = false
+	}
+	re, err := regexp.Compile("^(?s:" + expr.String() + ")$")
+	return prefix.String(), re, err
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/replication"
+)
+
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// setupRESP serves the Redis protocol on a local listener and connects a
+// raw TCP client to it.
+func setupRESP(t *testing.T) *respClient {
+	t.Helper()
+	setupDb(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRESPServer()
+	go s.Serve(lis)
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command as an array of bulk strings and returns the reply
+// rendered on one line, e.g. "+OK", ":1", "$v", "$nil" or "*[$a $b]".
+func (c *respClient) do(args ...string) string {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *respClient) read() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "$nil"
+		}
+		data, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return "$" + strings.TrimSuffix(data, "\r\n")
+	case '*':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return "*[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+func TestRESP(t *testing.T) {
+	c := setupRESP(t)
+
+	steps := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hi"}, "$hi"},
+		{[]string{"GET", "k"}, "$nil"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"GET", "k"}, "$v"},
+		{[]string{"SET", "k", ""}, "-ERR empty values are not supported"},
+		{[]string{"SET", "k", "v", "EX"}, "-ERR syntax error"},
+		{[]string{"SET", "k", "v", "EX", "zero"}, "-ERR value is not an integer or out of range"},
+		{[]string{"EXISTS", "k", "missing", "k"}, ":2"},
+		{[]string{"MSET", "a", "1", "b", "2"}, "+OK"},
+		{[]string{"MGET", "a", "missing", "b"}, "*[$1 $nil $2]"},
+		{[]string{"INCRBY", "a", "41"}, ":42"},
+		{[]string{"INCRBY", "counter", "-3"}, ":-3"},
+		{[]string{"INCRBY", "k", "1"}, "-ERR value is not an integer or out of range"},
+		{[]string{"INCRBY", "a", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"DEL", "a", "a", "missing"}, ":1"},
+		{[]string{"GET", "a"}, "$nil"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'flushall'"},
+	}
+	for _, s := range steps {
+		if reply := c.do(s.args...); reply != s.expected {
+			t.Errorf("%v: got %q, expected %q", s.args, reply, s.expected)
+		}
+	}
+
+	// Inline commands and pipelining.
+	if _, err := c.conn.Write([]byte("PING\r\nGET b\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if r1, r2 := c.read(), c.read(); r1 != "+PONG" || r2 != "$2" {
+		t.Errorf("pipelined inline commands replied %q, %q", r1, r2)
+	}
+}
+
+func TestRESP_ConcurrentDel(t *testing.T) {
+	setupDb(t)
+	c := caller{api: "RESP", principal: anonymous}
+
+	for round := 0; round < 20; round++ {
+		if reply := runRESPCommand(c, "set", []string{"k", "v"}); reply != "OK" {
+			t.Fatalf("SET replied %v", reply)
+		}
+		const clients = 8
+		counts := make(chan any, clients)
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				counts <- runRESPCommand(c, "del", []string{"k", "k"})
+			}()
+		}
+		wg.Wait()
+		close(counts)
+		var total int64
+		for n := range counts {
+			total += n.(int64)
+		}
+		if total != 1 {
+			t.Fatalf("DELs of one key counted %d deletions", total)
+		}
+	}
+}
+
+// TestRESP_Engines runs multi-key commands larger than an HTTP batch on the
+// engines without buckets.
+func TestRESP_Engines(t *testing.T) {
+	engines := map[string]func(dir string) (datastore.Store, error){
+		"sharded": func(dir string) (datastore.Store, error) {
+			return datastore.OpenSharded(dir, 3, datastore.Options{})
+		},
+		"lsm": func(dir string) (datastore.Store, error) {
+			return datastore.OpenLSM(dir)
+		},
+	}
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			store, err := open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, primary, follower = store, nil, nil
+			t.Cleanup(func() {
+				_ = store.Close()
+				db = nil
+			})
+			c := caller{api: "RESP", principal: anonymous}
+
+			const n = 2 * maxBatchOps
+			var pairs, keys []string
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("k%04d", i)
+				pairs = append(pairs, key, "v")
+				keys = append(keys, key)
+			}
+			if reply := runRESPCommand(c, "mset", pairs); reply != "OK" {
+				t.Fatalf("MSET replied %v", reply)
+			}
+			values, ok := runRESPCommand(c, "mget", keys).([]any)
+			if !ok || len(values) != n || values[n-1] == nil {
+				t.Fatalf("MGET replied %v", values)
+			}
+			if reply := runRESPCommand(c, "del", append(keys, keys[0])); reply != int64(n) {
+				t.Errorf("DEL replied %v, expected %d", reply, n)
+			}
+			if reply := runRESPCommand(c, "exists", keys); reply != int64(0) {
+				t.Errorf("EXISTS after DEL replied %v", reply)
+			}
+		})
+	}
+}
+
+func TestReadRESPCommand_Limits(t *testing.T) {
+	big := strings.Repeat("x", 5<<10)
+	cases := []struct {
+		input  string
+		limits respLimits
+		ok     bool
+	}{
+		{"*3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$6\r\nsecret\r\n", respNoAuthLimits, true},
+		{"*4\r\n", respNoAuthLimits, false},
+		{"*1048576\r\n", respNoAuthLimits, false},
+		{"*2\r\n$3\r\nSET\r\n$16777216\r\n", respNoAuthLimits, false},
+		{"*2\r\n$4\r\nAUTH\r\n$5120\r\n" + big + "\r\n", respNoAuthLimits, false},
+		{"*2\r\n$4\r\nAUTH\r\n$5120\r\n" + big + "\r\n", respAuthLimits, true},
+		{"AUTH " + big + big + "\r\n", respNoAuthLimits, false},
+		{"AUTH " + big + "\r\n", respAuthLimits, true},
+		{"*3\r\n$3\r\nSET\r\n$5120\r\n" + big + "\r\n$5120\r\n" + big + "\r\n",
+			respLimits{args: 3, bulkSize: 6 << 10, commandSize: 8 << 10}, false},
+	}
+	for i, tc := range cases {
+		_, err := readRESPCommand(bufio.NewReader(strings.NewReader(tc.input)), tc.limits)
+		if tc.ok && err != nil {
+			t.Errorf("case %d: %v", i, err)
+		} else if !tc.ok && !errors.Is(err, errRESPProtocol) {
+			t.Errorf("case %d: expected a protocol error, got %v", i, err)
+		}
+	}
+}
+
+func TestRESP_Expire(t *testing.T) {
+	c := setupRESP(t)
+
+	if reply := c.do("SET", "temp", "v", "PX", "50"); reply != "+OK" {
+		t.Fatalf("SET PX: %q", reply)
+	}
+	if reply := c.do("GET", "temp"); reply != "$v" {
+		t.Errorf("GET before expiry: %q", reply)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if reply := c.do("GET", "temp"); reply != "$nil" {
+		t.Errorf("GET after expiry: %q", reply)
+	}
+}
+
+func TestRESP_Scan(t *testing.T) {
+	c := setupRESP(t)
+
+	for i := 0; i < 25; i++ {
+		c.do("SET", fmt.Sprintf("user:%02d", i), "x")
+	}
+	c.do("SET", "other", "x")
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "10")
+		fields := strings.Fields(strings.Trim(reply, "*[]"))
+		cursor = strings.TrimPrefix(fields[0], "$")
+		for _, key := range fields[1:] {
+			keys = append(keys, strings.Trim(key, "*[]$"))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 25 || keys[0] != "user:00" || keys[24] != "user:24" {
+		t.Errorf("SCAN returned %v", keys)
+	}
+
+	if reply := c.do("SCAN", "0", "MATCH", "us?r:1[0-2]", "COUNT", "100"); reply != "*[$0 *[$user:10 $user:11 $user:12]]" {
+		t.Errorf("SCAN with a pattern: %q", reply)
+	}
+	if reply := c.do("SCAN", "0", "MATCH", "[z-a]"); reply != "-ERR invalid pattern" {
+		t.Errorf("SCAN with an invalid pattern: %q", reply)
+	}
+}
+
+func TestRESP_Follower(t *testing.T) {
+	c := setupRESP(t)
+	follower = replication.NewFollower("http://leader.invalid", primary)
+
+	for _, args := range [][]string{
+		{"SET", "k", "v"},
+		{"MSET", "k", "v"},
+		{"DEL", "k"},
+		{"INCRBY", "k", "1"},
+	} {
+		if reply := c.do(args...); !strings.HasPrefix(reply, "-READONLY") {
+			t.Errorf("%v on a follower: %q", args, reply)
+		}
+	}
+	if reply := c.do("GET", "k"); reply != "$nil" {
+		t.Errorf("GET on a follower: %q", reply)
+	}
+}
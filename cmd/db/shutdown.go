@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+)
+
+// serverCtx is cancelled when the service starts shutting down, ending
+// long-lived streams such as watches, so draining does not wait for them.
+var serverCtx = context.Background()
+
+// servers are the front-ends of the service, shut down together.
+type servers struct {
+	http *http.Server
+	// api serves health checks until the datastore is open.
+	api  *startupHandler
+	grpc *grpc.Server
+	resp *respServer
+	// errs receives the errors of servers that stopped on their own.
+	errs chan error
+}
+
+func newServers(tlsConfig *tls.Config) *servers {
+	api := &startupHandler{}
+	return &servers{
+		http: &http.Server{
+			Handler:     api,
+			BaseContext: func(net.Listener) context.Context { return serverCtx },
+		},
+		api:  api,
+		grpc: newGRPCServer(tlsConfig),
+		resp: newRESPServer(),
+		errs: make(chan error, 3),
+	}
+}
+
+func (s *servers) serve(name string, lis net.Listener, serve func(net.Listener) error, closed error) {
+	go func() {
+		if err := serve(lis); err != nil && !errors.Is(err, closed) {
+			s.errs <- fmt.Errorf("%s server: %w", name, err)
+		}
+	}()
+}
+
+func (s *servers) serveHTTP(lis net.Listener) {
+	s.serve("HTTP", lis, s.http.Serve, http.ErrServerClosed)
+}
+
+func (s *servers) serveGRPC(lis net.Listener) {
+	s.serve("gRPC", lis, s.grpc.Serve, grpc.ErrServerStopped)
+}
+
+func (s *servers) serveRESP(lis net.Listener) {
+	s.serve("RESP", lis, s.resp.Serve, net.ErrClosed)
+}
+
+// shutdown stops accepting requests and waits for the ones in progress
+// until ctx is done, then drops the remaining ones.
+func (s *servers) shutdown(ctx context.Context) error {
+	errs := make(chan error, 3)
+	go func() {
+		errs <- s.http.Shutdown(ctx)
+	}()
+	go func() {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			errs <- nil
+		case <-ctx.Done():
+			s.grpc.Stop()
+			errs <- ctx.Err()
+		}
+	}()
+	go func() {
+		errs <- s.resp.Shutdown(ctx)
+	}()
+
+	var err error
+	for range 3 {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
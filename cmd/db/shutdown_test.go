@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbrpc"
+)
+
+func TestServers_Shutdown(t *testing.T) {
+	setupDb(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	serverCtx = ctx
+	t.Cleanup(func() { serverCtx = context.Background() })
+
+	srv := newServers(nil)
+	srv.api.open(newHandler())
+	listen := func() net.Listener {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lis
+	}
+	httpLis, grpcLis, respLis := listen(), listen(), listen()
+	srv.serveHTTP(httpLis)
+	srv.serveGRPC(grpcLis)
+	srv.serveRESP(respLis)
+
+	// Long-lived streams and idle connections must not hold the shutdown.
+	resp, err := http.Get("http://" + httpLis.Addr().String() + "/db/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	conn, err := grpc.NewClient(grpcLis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	watch, err := dbrpc.NewDbClient(conn).Watch(context.Background(), &dbrpc.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respConn, err := net.Dial("tcp", respLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer respConn.Close()
+	if _, err := respConn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(respConn)
+	if line, err := r.ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Fatalf("PING replied %q, %v", line, err)
+	}
+
+	cancel()
+	start := time.Now()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := srv.shutdown(shutdownCtx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("watch stream was not ended cleanly: %v", err)
+	}
+	if _, err := watch.Recv(); err != io.EOF {
+		t.Errorf("gRPC watch stream ended with %v", err)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("RESP connection was not closed: %v", err)
+	}
+	if _, err := http.Get("http://" + httpLis.Addr().String() + "/db/k"); err == nil {
+		t.Error("HTTP server still accepts requests")
+	}
+	select {
+	case err := <-srv.errs:
+		t.Errorf("server failed: %v", err)
+	default:
+	}
+}
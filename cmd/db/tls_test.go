@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbrpc"
+	"github.com/roman-mazur/architecture-practice-4-template/tlstest"
+)
+
+// setupMutualTLS configures the service with a certificate and a client CA
+// of a throwaway CA and returns a client certificate signed by it.
+func setupMutualTLS(t *testing.T) (*tls.Config, *tlstest.CA, tls.Certificate) {
+	t.Helper()
+	ca := tlstest.NewCA(t)
+	certFile, keyFile := ca.Issue(t, "db", "127.0.0.1")
+	conf = &config{TLSCert: certFile, TLSKey: keyFile, TLSClientCA: ca.CertFile}
+	t.Cleanup(func() { conf = &config{} })
+	cfg, err := conf.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertFile, clientKeyFile := ca.Issue(t, "client")
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, ca, clientCert
+}
+
+func TestMutualTLS_HTTP(t *testing.T) {
+	h := setupDb(t)
+	cfg, ca, clientCert := setupMutualTLS(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(tls.NewListener(lis, cfg))
+	t.Cleanup(func() { _ = srv.Close() })
+	url := "https://" + lis.Addr().String() + "/db/k"
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.Pool(),
+			Certificates: certs,
+		}}}
+	}
+	if _, err := client().Get(url); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+	other := tlstest.NewCA(t)
+	otherCert, otherKey := other.Issue(t, "intruder")
+	intruder, err := tls.LoadX509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client(intruder).Get(url); err == nil {
+		t.Error("request with a certificate of another CA succeeded")
+	}
+
+	resp, err := client(clientCert).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func TestMutualTLS_GRPC(t *testing.T) {
+	setupDb(t)
+	cfg, ca, clientCert := setupMutualTLS(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGRPCServer(cfg)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	get := func(certs ...tls.Certificate) error {
+		creds := credentials.NewTLS(&tls.Config{RootCAs: ca.Pool(), Certificates: certs})
+		conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = dbrpc.NewDbClient(conn).Get(context.Background(), &dbrpc.GetRequest{Key: "k"})
+		return err
+	}
+	if err := get(); status.Code(err) != codes.Unavailable {
+		t.Errorf("Get without a client certificate: %v", err)
+	}
+	if err := get(clientCert); status.Code(err) != codes.NotFound {
+		t.Errorf("Get with a client certificate: %v", err)
+	}
+}
+
+func TestConfig_LeaderTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	certFile, keyFile := ca.Issue(t, "follower")
+	c := &config{Leader: "https://leader:8083", LeaderCA: ca.CertFile, TLSCert: certFile, TLSKey: keyFile}
+	cfg, err := c.leaderTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RootCAs == nil || len(cfg.Certificates) != 1 {
+		t.Errorf("leader TLS config %+v", cfg)
+	}
+	if cfg, _ := (&config{}).leaderTLSConfig(); cfg != nil {
+		t.Error("leader TLS config without any option")
+	}
+}
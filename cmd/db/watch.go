@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleWatch streams datastore changes as Server-Sent Events. A client can
+// resume with the standard Last-Event-ID header or an explicit "after" query
+// parameter; without either only new events are sent.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	// Events are filtered by the key prefixes of the token.
+	c := callerFrom(r.Context())
+	if !c.can(opRead) {
+		c.deny(opRead, r.URL.Query().Get("prefix"))
+		writeForbidden(w)
+		return
+	}
+
+	after := primary.LastSeq()
+	pos := r.URL.Query().Get("after")
+	if pos == "" {
+		pos = r.Header.Get("Last-Event-ID")
+	}
+	if pos != "" {
+		var err error
+		if after, err = strconv.ParseUint(pos, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid position")
+			return
+		}
+	}
+
+	events, err := primary.Watch(r.Context(), r.URL.Query().Get("prefix"), after)
+	if errors.Is(err, datastore.ErrWatchPositionLost) {
+		writeError(w, http.StatusGone, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for ev := range events {
+		if datastore.IsInternalKey(ev.Key) || !c.permits(opRead, ev.Key) {
+			continue
+		}
+		data, _ := json.Marshal(newWatchEvent(ev))
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// watchEvent is the data of an SSE event. Values that are not valid UTF-8
+// are sent base64-encoded in Data, as JSON strings cannot carry them.
+type watchEvent struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Data        []byte `json:"data,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+func newWatchEvent(ev datastore.Event) watchEvent {
+	we := watchEvent{Key: ev.Key, ContentType: ev.ContentType}
+	if utf8.ValidString(ev.Value) {
+		we.Value = ev.Value
+	} else {
+		we.Data = []byte(ev.Value)
+	}
+	return we
+}
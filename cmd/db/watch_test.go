@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatch_Binary(t *testing.T) {
+	srv := httptest.NewServer(setupDb(t))
+	defer srv.Close()
+
+	if err := primary.Put("k:text", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.PutTyped("k:blob", "\x00\xff", "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(srv.URL + "/db/watch?prefix=k:&after=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var events []watchEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 2 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev watchEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events: %v", len(events), scanner.Err())
+	}
+	if ev := events[0]; ev.Value != "plain" || ev.Data != nil || ev.ContentType != "" {
+		t.Errorf("text event %+v", ev)
+	}
+	if ev := events[1]; ev.Value != "" || string(ev.Data) != "\x00\xff" || ev.ContentType != "application/octet-stream" {
+		t.Errorf("binary event %+v", ev)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+var (
+	addr  = flag.String("addr", "http://localhost:8083", "address of the DB service")
+	token = flag.String("token", os.Getenv("DB_ADMIN_TOKEN"), "bearer token of the admin endpoints, DB_ADMIN_TOKEN by default")
+	ca    = flag.String("ca", "", "CA certificates file verifying an https service instead of the system roots")
+	cert  = flag.String("cert", "", "client certificate file presented to a service requiring one")
+	key   = flag.String("key", "", "private key file of -cert")
+)
+
+// client is configured by the flags in main.
+var client = new(http.Client)
+
+// tlsTransport configures the TLS flags on a copy of the default transport.
+func tlsTransport() (http.RoundTripper, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if *ca == "" && *cert == "" {
+		return t, nil
+	}
+	t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if *ca != "" {
+		data, err := os.ReadFile(*ca)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.RootCAs = x509.NewCertPool()
+		if !t.TLSClientConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates in %s", *ca)
+		}
+	}
+	if *cert != "" {
+		c, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{c}
+	}
+	return t, nil
+}
+
+// tokenTransport sends the -token flag with every request.
+type tokenTransport struct {
+	base http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if *token == "" {
+		return t.base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+*token)
+	return t.base.RoundTrip(r)
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: dbtool [flags] <command> [arguments]
+
+Commands:
+  export [file]                   write all records as JSON Lines to file or stdout
+  import [file]                   load JSON Lines records from file or stdin
+  backup [-full] <target>         store a backup in the target directory on the service host
+  backups <target>                list the backups in a local target directory
+  restore [-id N] <target> <dir>  restore a backup, the latest by default, into an empty data directory
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	transport, err := tlsTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client.Transport = tokenTransport{transport}
+
+	commands := map[string]func(args []string) error{
+		"export":  export,
+		"import":  importFile,
+		"backup":  backup,
+		"backups": listBackups,
+		"restore": restore,
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd(flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseArgs parses the flags of a command and checks the number of
+// positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) []string {
+	fs.Usage = usage
+	_ = fs.Parse(args)
+	if fs.NArg() < min || fs.NArg() > max {
+		usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func optionalArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func export(args []string) error {
+	file := optionalArg(parseArgs(flag.NewFlagSet("export", flag.ExitOnError), args, 0, 1))
+
+	resp, err := client.Get(*addr + "/admin/export")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("export: %s: %s", resp.Status, msg)
+	}
+
+	out := os.Stdout
+	if file != "" {
+		if out, err = os.Create(file); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return fmt.Errorf("export: %w", err)
+	}
+	return out.Close()
+}
+
+func importFile(args []string) error {
+	file := optionalArg(parseArgs(flag.NewFlagSet("import", flag.ExitOnError), args, 0, 1))
+
+	in := os.Stdin
+	if file != "" {
+		var err error
+		if in, err = os.Open(file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	resp, err := client.Post(*addr+"/admin/import", "application/x-ndjson", in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Imported int `json:"imported"`
+		Error    *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("import: %s", resp.Status)
+	}
+	if res.Error != nil {
+		return fmt.Errorf("import: %s (%d records stored)", res.Error.Message, res.Imported)
+	}
+	log.Printf("imported %d records", res.Imported)
+	return nil
+}
+
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	full := fs.Bool("full", false, "copy all segments instead of only the ones missing in the previous backup")
+	target := parseArgs(fs, args, 1, 1)[0]
+	if abs, err := filepath.Abs(target); err == nil {
+		target = abs
+	}
+
+	q := url.Values{"target": {target}, "full": {strconv.FormatBool(*full)}}
+	resp, err := client.Post(*addr+"/admin/backup?"+q.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("backup: %s: %s", resp.Status, msg)
+	}
+
+	var info datastore.BackupInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	log.Printf("backup %d stored in %s: %d files, %d bytes copied", info.ID, target, len(info.Files), info.CopiedBytes)
+	return nil
+}
+
+func listBackups(args []string) error {
+	target := parseArgs(flag.NewFlagSet("backups", flag.ExitOnError), args, 1, 1)[0]
+	backups, err := datastore.ListBackups(target)
+	if err != nil {
+		return err
+	}
+	for _, info := range backups {
+		kind := "incremental"
+		if info.Full {
+			kind = "full"
+		}
+		fmt.Printf("%d\t%s\t%s\tseq %d\t%d files\t%d bytes copied\n",
+			info.ID, info.Time.Format("2006-01-02T15:04:05Z"), kind, info.LastSeq, len(info.Files), info.CopiedBytes)
+	}
+	return nil
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	id := fs.Int("id", 0, "id of the backup to restore, the latest if zero")
+	rest := parseArgs(fs, args, 2, 2)
+	if err := datastore.Restore(rest[0], *id, rest[1]); err != nil {
+		return err
+	}
+	log.Printf("restored %s", rest[1])
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// The DB service is configured with these environment variables. The CA
+// file verifies an https DB instead of the system roots, and the client
+// certificate is presented when the DB requires one.
+const (
+	confDBURL      = "CONF_DB_URL"
+	confDBToken    = "CONF_DB_TOKEN"
+	confDBCAFile   = "CONF_DB_CA_FILE"
+	confDBCertFile = "CONF_DB_CERT_FILE"
+	confDBKeyFile  = "CONF_DB_KEY_FILE"
+
+	defaultDBURL = "http://db:8083"
+)
+
+func dbURL() string {
+	if url := os.Getenv(confDBURL); url != "" {
+		return url
+	}
+	return defaultDBURL
+}
+
+// newDBClient creates the HTTP client of the DB service.
+func newDBClient() (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	caFile, certFile, keyFile := os.Getenv(confDBCAFile), os.Getenv(confDBCertFile), os.Getenv(confDBKeyFile)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", confDBCertFile, confDBKeyFile)
+	}
+	if caFile != "" || certFile != "" {
+		t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates in %s", caFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: tokenTransport{base: t, token: os.Getenv(confDBToken)}}, nil
+}
+
+// tokenTransport sends the bearer token required by the DB service when
+// authentication is on there.
+type tokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.token == "" {
+		return t.base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/tlstest"
+)
+
+func TestDBClient_MutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "db", "127.0.0.1")
+	clientCert, clientKey := ca.Issue(t, "server")
+
+	db := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	db.StartTLS()
+	defer db.Close()
+
+	t.Setenv(confDBCAFile, ca.CertFile)
+	t.Setenv(confDBToken, "s3cret")
+	c, err := newDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(db.URL); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+
+	t.Setenv(confDBCertFile, clientCert)
+	t.Setenv(confDBKeyFile, clientKey)
+	if c, err = newDBClient(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(db.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+
+	t.Setenv(confDBKeyFile, "")
+	if _, err := newDBClient(); err == nil {
+		t.Error("a client certificate without a key was accepted")
+	}
+}
@@ -25,6 +25,11 @@ const (
 
 func main() {
 	flag.Parse()
+	dbClient, err := newDBClient()
+	if err != nil {
+		log.Fatalf("invalid DB client config: %v", err)
+	}
+	db := dbURL()
 	h := http.NewServeMux()
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -53,7 +58,7 @@ func main() {
 			return
 		}
 
-		resp, err := http.Get("http://db:8083/db/" + key)
+		resp, err := dbClient.Get(db + "/db/" + key)
 		if err != nil {
 			http.Error(rw, "failed to query db", http.StatusInternalServerError)
 			return
@@ -72,12 +77,12 @@ func main() {
 
 	today := time.Now().Format("2006-01-02")
 	postBody := fmt.Sprintf(`{"value":"%s"}`, today)
-	resp, err := http.Post("http://db:8083/db/"+teamKey, "application/json", strings.NewReader(postBody))
+	resp, err := dbClient.Post(db+"/db/"+teamKey, "application/json", strings.NewReader(postBody))
 	if err != nil {
 		log.Fatalf("failed to POST initial data to DB: %v", err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		log.Fatalf("unexpected status from DB POST: %d; body=%s", resp.StatusCode, string(bodyBytes))
 	}
@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const backupManifestName = "MANIFEST.json"
+
+var (
+	ErrBackupNotFound  = fmt.Errorf("backup does not exist")
+	ErrRestoreNotEmpty = fmt.Errorf("restore directory is not empty")
+)
+
+// BackupFile is a data file that is part of a backup. Closed segments are
+// immutable, so a segment with the same name, size, modification time and
+// first sequence number as in the previous backup is not copied again but
+// referenced. Sequence numbers are never reused, which tells a segment apart
+// from one created with the same name after a merge.
+type BackupFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	FirstSeq uint64    `json:"firstSeq"`
+	// Backup is the id of the backup holding a copy of the file.
+	Backup int `json:"backup"`
+}
+
+// BackupInfo describes a backup. Files lists everything needed to restore
+// it: the closed segments followed by the active file.
+type BackupInfo struct {
+	ID          int          `json:"id"`
+	Time        time.Time    `json:"time"`
+	Full        bool         `json:"full"`
+	LastSeq     uint64       `json:"lastSeq"`
+	CopiedBytes int64        `json:"copiedBytes"`
+	Files       []BackupFile `json:"files"`
+}
+
+// key identifies the contents of a closed segment.
+func (f BackupFile) key() string {
+	return fmt.Sprintf("%s/%d/%d/%d", f.Name, f.Size, f.ModTime.UnixNano(), f.FirstSeq)
+}
+
+type backupManifest struct {
+	Backups []BackupInfo `json:"backups"`
+}
+
+func backupDir(target string, id int) string {
+	return filepath.Join(target, fmt.Sprintf("backup-%06d", id))
+}
+
+func readBackupManifest(target string) (*backupManifest, error) {
+	var m backupManifest
+	data, err := os.ReadFile(filepath.Join(target, backupManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return &m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("backup manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func (m *backupManifest) write(target string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(target, backupManifestName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(target, backupManifestName))
+}
+
+// ListBackups returns the backups stored in target, oldest first.
+func ListBackups(target string) ([]BackupInfo, error) {
+	m, err := readBackupManifest(target)
+	if err != nil {
+		return nil, err
+	}
+	return m.Backups, nil
+}
+
+type backupSource struct {
+	f    *os.File
+	file BackupFile
+}
+
+// snapshotFiles opens every data file in the writer, so that no rotation
+// happens in between, and returns them with the length of the active file
+// at that point. Open files stay readable when a merge removes them.
+func (db *Db) snapshotFiles() ([]backupSource, uint64, error) {
+	var sources []backupSource
+	var lastSeq uint64
+	add := func(path, name string, size int64) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if size < 0 {
+			size = info.Size()
+		}
+		sources = append(sources, backupSource{f: f, file: BackupFile{Name: name, Size: size, ModTime: info.ModTime().UTC()}})
+		return nil
+	}
+
+	err := db.run(func() error {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		for _, seg := range db.segments {
+			if err := add(seg.path, filepath.Base(seg.path), -1); err != nil {
+				return err
+			}
+			first, err := firstSeq(seg.path)
+			if err != nil {
+				return err
+			}
+			sources[len(sources)-1].file.FirstSeq = first
+		}
+		lastSeq = db.lastSeq.Load()
+		return add(filepath.Join(db.dir, outFileName), outFileName, db.outOffset)
+	})
+	if err != nil {
+		for _, src := range sources {
+			src.f.Close()
+		}
+		return nil, 0, err
+	}
+	return sources, lastSeq, nil
+}
+
+func firstSeq(path string) (uint64, error) {
+	r, err := openSegmentReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.close()
+	rec, _, err := r.next()
+	if errors.Is(err, io.EOF) {
+		return 0, nil
+	}
+	return rec.seq, err
+}
+
+// Backup stores the state of the datastore as a new backup in the target
+// directory. Unless full is set, closed segments already stored by the
+// previous backup are not copied again. The active file is always copied.
+func (db *Db) Backup(target string, full bool) (*BackupInfo, error) {
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return nil, err
+	}
+	m, err := readBackupManifest(target)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &BackupInfo{ID: 1, Time: time.Now().UTC(), Full: full || len(m.Backups) == 0}
+	stored := make(map[string]int)
+	if n := len(m.Backups); n > 0 {
+		prev := m.Backups[n-1]
+		info.ID = prev.ID + 1
+		for _, f := range prev.Files[:len(prev.Files)-1] {
+			stored[f.key()] = f.Backup
+		}
+	}
+
+	sources, lastSeq, err := db.snapshotFiles()
+	if err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	defer func() {
+		for _, src := range sources {
+			src.f.Close()
+		}
+	}()
+	info.LastSeq = lastSeq
+
+	dir := backupDir(target, info.ID)
+	tmpDir := dir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(tmpDir, 0o755); err != nil {
+		return nil, err
+	}
+	for i, src := range sources {
+		file := src.file
+		isActive := i == len(sources)-1
+		if id, ok := stored[file.key()]; ok && !info.Full && !isActive {
+			file.Backup = id
+		} else {
+			if err := copyFile(filepath.Join(tmpDir, file.Name), src.f, file.Size); err != nil {
+				os.RemoveAll(tmpDir)
+				return nil, fmt.Errorf("backup %s: %w", file.Name, err)
+			}
+			file.Backup = info.ID
+			info.CopiedBytes += file.Size
+		}
+		info.Files = append(info.Files, file)
+	}
+
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	m.Backups = append(m.Backups, *info)
+	if err := m.write(target); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	return info, nil
+}
+
+func copyFile(path string, src *os.File, size int64) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, io.NewSectionReader(src, 0, size), size); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Restore recreates the data directory dir from the backup with the given
+// id in target, the latest one if id is zero. The datastore must not be
+// open on dir, which has to be empty or missing.
+func Restore(target string, id int, dir string) error {
+	m, err := readBackupManifest(target)
+	if err != nil {
+		return err
+	}
+	var info *BackupInfo
+	for i := range m.Backups {
+		if m.Backups[i].ID == id || (id == 0 && i == len(m.Backups)-1) {
+			info = &m.Backups[i]
+		}
+	}
+	if info == nil {
+		return ErrBackupNotFound
+	}
+
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return ErrRestoreNotEmpty
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, file := range info.Files {
+		src, err := os.Open(filepath.Join(backupDir(target, file.Backup), file.Name))
+		if err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		err = copyFile(filepath.Join(dir, file.Name), src, file.Size)
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
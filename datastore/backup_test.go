@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func exportString(t *testing.T, db *Db) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestBackupRestore(t *testing.T) {
+	saved := MaxSegmentSize
+	MaxSegmentSize = 128
+	t.Cleanup(func() { MaxSegmentSize = saved })
+
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	target := t.TempDir()
+
+	put := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i%15), fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var states []string
+	backup := func(full bool) *BackupInfo {
+		t.Helper()
+		info, err := db.Backup(target, full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, exportString(t, db))
+		return info
+	}
+
+	put(0, 20)
+	base := backup(false)
+	if !base.Full || base.ID != 1 {
+		t.Errorf("first backup must be full: %+v", base)
+	}
+
+	put(20, 40)
+	inc := backup(false)
+	var reused int
+	var copied int64
+	for _, f := range inc.Files {
+		if f.Backup == base.ID {
+			reused++
+		} else {
+			copied += f.Size
+		}
+	}
+	if reused != len(base.Files)-1 || copied != inc.CopiedBytes {
+		t.Errorf("incremental backup copied segments again: %+v", inc)
+	}
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	put(40, 50)
+	backup(false)
+	if full := backup(true); full.CopiedBytes == 0 {
+		t.Errorf("full backup copied nothing")
+	}
+
+	backups, err := ListBackups(target)
+	if err != nil || len(backups) != 4 {
+		t.Fatalf("ListBackups() = %d backups, %v", len(backups), err)
+	}
+	for i, info := range backups {
+		dir := filepath.Join(t.TempDir(), "data")
+		if err := Restore(target, info.ID, dir); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := exportString(t, restored); got != states[i] {
+			t.Errorf("backup %d restored\n%s\nexpected\n%s", info.ID, got, states[i])
+		}
+		if restored.LastSeq() != info.LastSeq {
+			t.Errorf("backup %d restored LastSeq %d, expected %d", info.ID, restored.LastSeq(), info.LastSeq)
+		}
+		if err := restored.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Restore(target, 99, t.TempDir()); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("expected ErrBackupNotFound, got %v", err)
+	}
+	if err := Restore(target, 0, target); !errors.Is(err, ErrRestoreNotEmpty) {
+		t.Errorf("expected ErrRestoreNotEmpty, got %v", err)
+	}
+}
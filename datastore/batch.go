@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+var ErrInvalidTTL = fmt.Errorf("TTL must be positive")
+
+// Batch collects writes that a BatchWriter applies atomically.
+type Batch struct {
+	records []entry
+	err     error
+}
+
+func (b *Batch) Put(key, value string) {
+	b.records = append(b.records, entry{key: key, value: value})
+}
+
+func (b *Batch) PutTTL(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		b.err = ErrInvalidTTL
+		return
+	}
+	b.records = append(b.records, entry{key: key, value: value, expiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+func (b *Batch) Delete(key string) {
+	b.records = append(b.records, entry{key: key})
+}
+
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+type BatchWriter interface {
+	Write(b *Batch) error
+}
+
+// Txn is a Batch whose Get sees the writes collected so far, so reads and
+// writes can be evaluated in order.
+type Txn struct {
+	Batch
+	get func(key string) (entry, error)
+}
+
+// Get returns the value of key as the writes of tx so far leave it.
+func (tx *Txn) Get(key string) (string, error) {
+	for i := len(tx.records) - 1; i >= 0; i-- {
+		if rec := tx.records[i]; rec.key == key {
+			if rec.value == "" || rec.expired(time.Now()) {
+				return "", ErrNotFound
+			}
+			return rec.value, nil
+		}
+	}
+	rec, err := tx.get(key)
+	return rec.value, err
+}
+
+// Transactor runs fn and applies the writes it collects in tx atomically,
+// unless fn fails. No other write lands between the reads of fn and its
+// writes.
+type Transactor interface {
+	Transact(fn func(tx *Txn) error) error
+}
+
+type TTLWriter interface {
+	PutTTL(key, value string, ttl time.Duration) error
+}
+
+type Updater interface {
+	Update(key string, fn func(value string, found bool) (string, error)) error
+}
+
+// TypedStore keeps the media type of values stored with PutTyped, e.g. to
+// serve them back with their Content-Type. Values written otherwise have an
+// empty type, and Update keeps the type of the value it replaces.
+type TypedStore interface {
+	PutTyped(key, value, contentType string) error
+	GetTyped(key string) (value, contentType string, err error)
+}
+
+// Swapper stores or, for an empty value, deletes the value of a key and
+// tells whether the key had a live value, checked in the same step as the
+// write.
+type Swapper interface {
+	Swap(key, value, contentType string) (found bool, err error)
+}
+
+// ValueInfo describes a stored value without its contents.
+type ValueInfo struct {
+	Size        int
+	ContentType string
+	// ExpiresAt is zero for values without TTL.
+	ExpiresAt time.Time
+}
+
+func (rec entry) info(size int) ValueInfo {
+	info := ValueInfo{Size: size, ContentType: rec.contentType}
+	if rec.expiresAt != 0 {
+		info.ExpiresAt = time.Unix(0, rec.expiresAt)
+	}
+	return info
+}
+
+// Stater describes values without reading them.
+type Stater interface {
+	Stat(key string) (ValueInfo, error)
+}
+
+var (
+	_ BatchWriter = (*Db)(nil)
+	_ BatchWriter = (*MemStore)(nil)
+	_ Transactor  = (*Db)(nil)
+	_ Transactor  = (*MemStore)(nil)
+	_ Transactor  = (*LSMStore)(nil)
+	_ TTLWriter   = (*Db)(nil)
+	_ TTLWriter   = (*MemStore)(nil)
+	_ TTLWriter   = (*ShardedDb)(nil)
+	_ Updater     = (*Db)(nil)
+	_ Updater     = (*ShardedDb)(nil)
+	_ TypedStore  = (*Db)(nil)
+	_ TypedStore  = (*Bucket)(nil)
+	_ TypedStore  = (*MemStore)(nil)
+	_ TypedStore  = (*ShardedDb)(nil)
+	_ Swapper     = (*Db)(nil)
+	_ Swapper     = (*Bucket)(nil)
+	_ Swapper     = (*ShardedDb)(nil)
+	_ Swapper     = (*MemStore)(nil)
+	_ Swapper     = (*LSMStore)(nil)
+	_ Stater      = (*Db)(nil)
+	_ Stater      = (*Bucket)(nil)
+	_ Stater      = (*ShardedDb)(nil)
+	_ Stater      = (*MemStore)(nil)
+	_ Stater      = (*LSMStore)(nil)
+)
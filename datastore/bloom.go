@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+const DefaultBloomFalsePositiveRate = 0.01
+
+const bloomSuffix = ".bloom"
+
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	k      uint32
+	count  int
+	fpRate float64
+}
+
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultBloomFalsePositiveRate
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		m:      m,
+		k:      k,
+		fpRate: fpRate,
+	}
+}
+
+// doubleHash derives the two base hashes used for double hashing.
+func doubleHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, sum>>33 | sum<<31 | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := doubleHash(key)
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.count++
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := doubleHash(key)
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// estimatedFalsePositiveRate is the expected rate for the number of keys
+// actually added, which may differ from the configured one.
+func (b *bloomFilter) estimatedFalsePositiveRate() float64 {
+	return math.Pow(1-math.Exp(-float64(b.k)*float64(b.count)/float64(b.m)), float64(b.k))
+}
+
+// 0   8   12      16          20    <-- offset
+// (m) (k) (count) (fpRate*1e6) (bits...)
+
+func (b *bloomFilter) Encode() []byte {
+	res := make([]byte, 20+8*len(b.bits))
+	binary.LittleEndian.PutUint64(res, b.m)
+	binary.LittleEndian.PutUint32(res[8:], b.k)
+	binary.LittleEndian.PutUint32(res[12:], uint32(b.count))
+	binary.LittleEndian.PutUint32(res[16:], uint32(b.fpRate*1e6))
+	for i, w := range b.bits {
+		binary.LittleEndian.PutUint64(res[20+8*i:], w)
+	}
+	return res
+}
+
+func decodeBloomFilter(input []byte) (*bloomFilter, error) {
+	if len(input) < 20 {
+		return nil, fmt.Errorf("bloom filter is truncated")
+	}
+	b := &bloomFilter{
+		m:      binary.LittleEndian.Uint64(input),
+		k:      binary.LittleEndian.Uint32(input[8:]),
+		count:  int(binary.LittleEndian.Uint32(input[12:])),
+		fpRate: float64(binary.LittleEndian.Uint32(input[16:])) / 1e6,
+	}
+	words := (b.m + 63) / 64
+	if b.m == 0 || b.k == 0 || uint64(len(input)-20) != words*8 {
+		return nil, fmt.Errorf("bloom filter is corrupted")
+	}
+	b.bits = make([]uint64, words)
+	for i := range b.bits {
+		b.bits[i] = binary.LittleEndian.Uint64(input[20+8*i:])
+	}
+	return b, nil
+}
+
+func bloomPath(segPath string) string {
+	return strings.TrimSuffix(segPath, ".dat") + bloomSuffix
+}
+
+// buildSegmentFilter reads every key of a closed segment and persists the
+// resulting filter next to it.
+func buildSegmentFilter(segPath string, fpRate float64) (*bloomFilter, error) {
+	r, err := openSegmentReader(segPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	var keys []string
+	for {
+		rec, _, err := r.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("buildSegmentFilter: %w", err)
+		}
+		keys = append(keys, rec.key)
+	}
+
+	b := newBloomFilter(len(keys), fpRate)
+	for _, key := range keys {
+		b.add(key)
+	}
+
+	tmp := bloomPath(segPath) + ".tmp"
+	if err := os.WriteFile(tmp, b.Encode(), 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, bloomPath(segPath)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// loadSegmentFilter reads a persisted filter, rebuilding it when it is
+// missing, unreadable or was built for another false positive rate.
+func loadSegmentFilter(segPath string, fpRate float64) (*bloomFilter, error) {
+	data, err := os.ReadFile(bloomPath(segPath))
+	if err == nil {
+		b, err := decodeBloomFilter(data)
+		if err == nil && math.Abs(b.fpRate-fpRate) < 1e-6 {
+			return b, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return buildSegmentFilter(segPath, fpRate)
+}
@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	b := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		b.add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !b.mayContain(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("false negative for key-%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if b.mayContain(fmt.Sprintf("missing-%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.03 {
+		t.Errorf("false positive rate %.4f is too high", rate)
+	}
+
+	decoded, err := decodeBloomFilter(b.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.m != b.m || decoded.k != b.k || decoded.count != b.count || !decoded.mayContain("key-1") {
+		t.Error("Encode/decode mismatch")
+	}
+}
+
+func TestSegmentFilters(t *testing.T) {
+	dir := t.TempDir()
+
+	oldMax := MaxSegmentSize
+	MaxSegmentSize = 1024
+	defer func() { MaxSegmentSize = oldMax }()
+
+	opts := Options{IndexMode: SparseIndexMode}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("key_%d", i), strings.Repeat("x", 90)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "seg_0.bloom")); err != nil {
+		t.Fatalf("expected a filter next to the first segment: %v", err)
+	}
+	st := db.Stats()
+	if len(st.Segments) == 0 || st.Segments[0].BloomKeys == 0 {
+		t.Fatalf("expected filter stats for closed segments, got %+v", st)
+	}
+	if st.BloomFalsePositiveRate != DefaultBloomFalsePositiveRate {
+		t.Errorf("unexpected configured rate %v", st.BloomFalsePositiveRate)
+	}
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "seg_1.bloom")); !os.IsNotExist(err) {
+		t.Errorf("expected filters of merged segments to be removed, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if len(db.Stats().Segments) != 1 {
+		t.Errorf("expected the merged segment filter to be loaded, got %+v", db.Stats().Segments)
+	}
+	if v, err := db.Get("key_3"); err != nil || len(v) != 90 {
+		t.Errorf("Get(key_3) = (%q, %v)", v, err)
+	}
+}
+
+func TestSegmentFilters_Rate(t *testing.T) {
+	dir := t.TempDir()
+
+	oldMax := MaxSegmentSize
+	MaxSegmentSize = 1024
+	defer func() { MaxSegmentSize = oldMax }()
+
+	for _, rate := range []float64{0.01, 0.001} {
+		db, err := OpenWithOptions(dir, Options{IndexMode: SparseIndexMode, BloomFalsePositiveRate: rate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 30; i++ {
+			if err := db.Put(fmt.Sprintf("key_%d", i), strings.Repeat("x", 90)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if st := db.Stats(); st.BloomFalsePositiveRate != rate {
+			t.Errorf("configured rate %v, stats report %v", rate, st.BloomFalsePositiveRate)
+		}
+		// Filters built for another rate are rebuilt on open.
+		for _, seg := range db.segments {
+			if seg.filter.fpRate != rate {
+				t.Errorf("filter of %s built for %v, expected %v", seg.path, seg.filter.fpRate, rate)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The in-memory index of the hash mode answers lookups without segment I/O,
+// so no filters are built for it.
+func TestSegmentFilters_HashMode(t *testing.T) {
+	dir := t.TempDir()
+
+	oldMax := MaxSegmentSize
+	MaxSegmentSize = 1024
+	defer func() { MaxSegmentSize = oldMax }()
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("key_%d", i), strings.Repeat("x", 90)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.bloom")); len(matches) != 0 {
+		t.Errorf("filters built in hash mode: %v", matches)
+	}
+	if st := db.Stats(); len(st.Segments) == 0 || st.Segments[0].BloomKeys != 0 {
+		t.Errorf("unexpected filter stats in hash mode: %+v", st.Segments)
+	}
+}
@@ -0,0 +1,256 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBucketNotFound = fmt.Errorf("bucket does not exist")
+	ErrBucketExists   = fmt.Errorf("bucket already exists")
+	ErrInvalidBucket  = fmt.Errorf("invalid bucket name")
+)
+
+// Buckets are stored in the same log as plain keys under reserved internal
+// prefixes. Plain keys must not start with internalKeyPrefix.
+//
+//	\x00m\x00{name}         -> bucket id   (bucket metadata)
+//	\x00d\x00{id}\x00{key}  -> value       (bucket data)
+//	\x00c\x00bucket         -> last id     (bucket id counter)
+//
+// Dropping a bucket only deletes its metadata record. Data records of a
+// bucket id that is no longer live are invisible and reclaimed by merge, and
+// a bucket created again with the same name gets a new id.
+const (
+	internalKeyPrefix = "\x00"
+	bucketMetaPrefix  = "\x00m\x00"
+	bucketDataPrefix  = "\x00d\x00"
+	bucketCounterKey  = "\x00c\x00bucket"
+)
+
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+func validBucketName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\x00") && !strings.HasPrefix(name, "_")
+}
+
+func bucketKeyPrefix(id string) string {
+	return bucketDataPrefix + id + "\x00"
+}
+
+// trackBucket keeps the in-memory bucket table in sync with metadata records
+// passing through recovery or the writer. Callers hold db.mu.
+func (db *Db) trackBucket(rec entry) {
+	if !strings.HasPrefix(rec.key, bucketMetaPrefix) {
+		return
+	}
+	name := strings.TrimPrefix(rec.key, bucketMetaPrefix)
+	if rec.value == "" {
+		delete(db.buckets, name)
+	} else {
+		db.buckets[name] = rec.value
+	}
+}
+
+// loadBuckets fills the bucket table in sparse index mode, where closed
+// segments are not replayed on open.
+func (db *Db) loadBuckets() error {
+	db.mu.Lock()
+	db.buckets = make(map[string]string)
+	db.mu.Unlock()
+	return db.Scan(bucketMetaPrefix, func(key, value string) error {
+		db.mu.Lock()
+		db.buckets[strings.TrimPrefix(key, bucketMetaPrefix)] = value
+		db.mu.Unlock()
+		return nil
+	})
+}
+
+// deadBucketKey reports whether key belongs to a dropped bucket.
+func deadBucketKey(key string, live map[string]struct{}) bool {
+	if !strings.HasPrefix(key, bucketDataPrefix) {
+		return false
+	}
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, bucketDataPrefix), "\x00")
+	if !ok {
+		return true
+	}
+	_, alive := live[id]
+	return !alive
+}
+
+func (db *Db) liveBucketIDs() map[string]struct{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	live := make(map[string]struct{}, len(db.buckets))
+	for _, id := range db.buckets {
+		live[id] = struct{}{}
+	}
+	return live
+}
+
+func (db *Db) CreateBucket(name string) error {
+	if !validBucketName(name) {
+		return ErrInvalidBucket
+	}
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+
+	db.mu.RLock()
+	_, exists := db.buckets[name]
+	db.mu.RUnlock()
+	if exists {
+		return ErrBucketExists
+	}
+	// Ids come from a counter kept in the log, so they are never reused,
+	// not even for buckets dropped and reclaimed by a merge.
+	var last uint64
+	if rec, err := db.lookup(bucketCounterKey); err == nil {
+		if last, err = strconv.ParseUint(rec.value, 36, 64); err != nil {
+			return fmt.Errorf("invalid bucket id counter: %w", err)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	id := strconv.FormatUint(last+1, 36)
+	return db.write(
+		entry{key: bucketCounterKey, value: id},
+		entry{key: bucketMetaPrefix + name, value: id},
+	)
+}
+
+// DropBucket removes a bucket with all its keys in constant time.
+func (db *Db) DropBucket(name string) error {
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+
+	db.mu.RLock()
+	_, exists := db.buckets[name]
+	db.mu.RUnlock()
+	if !exists {
+		return ErrBucketNotFound
+	}
+	return db.write(entry{key: bucketMetaPrefix + name})
+}
+
+func (db *Db) Buckets() []string {
+	db.mu.RLock()
+	names := make([]string, 0, len(db.buckets))
+	for name := range db.buckets {
+		names = append(names, name)
+	}
+	db.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Bucket is a handle to the keys of a single bucket. It stops working once
+// the bucket is dropped, even if a bucket with the same name is created
+// again.
+type Bucket struct {
+	db     *Db
+	name   string
+	id     string
+	prefix string
+}
+
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	db.mu.RLock()
+	id, ok := db.buckets[name]
+	db.mu.RUnlock()
+	if !ok {
+		return nil, ErrBucketNotFound
+	}
+	return &Bucket{db: db, name: name, id: id, prefix: bucketKeyPrefix(id)}, nil
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) check() error {
+	b.db.mu.RLock()
+	id, ok := b.db.buckets[b.name]
+	b.db.mu.RUnlock()
+	if !ok || id != b.id {
+		return ErrBucketNotFound
+	}
+	return nil
+}
+
+// RawKey returns the key under which key of the bucket is stored in the
+// database, for writes combined with other keys in one Batch.
+func (b *Bucket) RawKey(key string) string {
+	return b.prefix + key
+}
+
+func (b *Bucket) Put(key, value string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.Put(b.prefix+key, value)
+}
+
+func (b *Bucket) PutTTL(key, value string, ttl time.Duration) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.PutTTL(b.prefix+key, value, ttl)
+}
+
+func (b *Bucket) PutTyped(key, value, contentType string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.PutTyped(b.prefix+key, value, contentType)
+}
+
+func (b *Bucket) GetTyped(key string) (string, string, error) {
+	if err := b.check(); err != nil {
+		return "", "", err
+	}
+	return b.db.GetTyped(b.prefix + key)
+}
+
+func (b *Bucket) Swap(key, value, contentType string) (bool, error) {
+	if err := b.check(); err != nil {
+		return false, err
+	}
+	return b.db.Swap(b.prefix+key, value, contentType)
+}
+
+func (b *Bucket) Stat(key string) (ValueInfo, error) {
+	if err := b.check(); err != nil {
+		return ValueInfo{}, err
+	}
+	return b.db.Stat(b.prefix + key)
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	if err := b.check(); err != nil {
+		return "", err
+	}
+	return b.db.Get(b.prefix + key)
+}
+
+func (b *Bucket) Delete(key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.Delete(b.prefix + key)
+}
+
+func (b *Bucket) Scan(prefix string, fn func(key, value string) error) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.Scan(b.prefix+prefix, func(key, value string) error {
+		return fn(strings.TrimPrefix(key, b.prefix), value)
+	})
+}
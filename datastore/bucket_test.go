@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) { testBuckets(t, mode) })
+	}
+}
+
+func testBuckets(t *testing.T, mode IndexMode) {
+	dir := t.TempDir()
+
+	oldMax := MaxSegmentSize
+	MaxSegmentSize = 512
+	defer func() { MaxSegmentSize = oldMax }()
+
+	db, err := OpenWithOptions(dir, Options{IndexMode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateBucket("app1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateBucket("app2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateBucket("app1"); err != ErrBucketExists {
+		t.Errorf("expected ErrBucketExists, got %v", err)
+	}
+	if err := db.CreateBucket("_reserved"); err != ErrInvalidBucket {
+		t.Errorf("expected ErrInvalidBucket, got %v", err)
+	}
+	if got := db.Buckets(); !reflect.DeepEqual(got, []string{"app1", "app2"}) {
+		t.Errorf("Buckets() = %v", got)
+	}
+
+	app1, _ := db.Bucket("app1")
+	app2, _ := db.Bucket("app2")
+	if err := db.Put("k", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := app1.Put(fmt.Sprintf("k%d", i), strings.Repeat("1", 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app1.Put("k", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app2.Put("k", "two"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		get  func(string) (string, error)
+		want string
+	}{{db.Get, "plain"}, {app1.Get, "one"}, {app2.Get, "two"}} {
+		if v, err := c.get("k"); err != nil || v != c.want {
+			t.Errorf("Get(k) = (%q, %v), want %q", v, err, c.want)
+		}
+	}
+
+	var keys []string
+	if err := app2.Scan("", func(key, _ string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"k"}) {
+		t.Errorf("app2 scan returned %v", keys)
+	}
+
+	if err := db.DropBucket("app1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app1.Get("k"); err != ErrBucketNotFound {
+		t.Errorf("expected ErrBucketNotFound from a dropped bucket, got %v", err)
+	}
+	if err := db.CreateBucket("app1"); err != nil {
+		t.Fatal(err)
+	}
+	recreated, _ := db.Bucket("app1")
+	if _, err := recreated.Get("k"); err != ErrNotFound {
+		t.Errorf("recreated bucket must be empty, got %v", err)
+	}
+	if recreated.id == app1.id {
+		t.Errorf("recreated bucket reuses the id %s", app1.id)
+	}
+	countData := func() int {
+		t.Helper()
+		n := 0
+		if err := db.Scan(bucketDataPrefix, func(string, string) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := countData(); n != 1 {
+		t.Errorf("expected only app2 data in a scan after the drop, got %d records", n)
+	}
+	var exported bytes.Buffer
+	if _, err := db.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	for dec := json.NewDecoder(&exported); dec.More(); {
+		var rec ExportRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(rec.Key, app1.prefix) {
+			t.Errorf("export contains %q of the dropped bucket", rec.Key)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(dir, Options{IndexMode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if got := db.Buckets(); !reflect.DeepEqual(got, []string{"app1", "app2"}) {
+		t.Errorf("Buckets() after reopen = %v", got)
+	}
+	if err := db.CreateBucket("app3"); err != nil {
+		t.Fatal(err)
+	}
+	app3, _ := db.Bucket("app3")
+	for _, id := range []string{app1.id, app2.id, recreated.id} {
+		if app3.id == id {
+			t.Errorf("bucket created after reopen reuses the id %s", id)
+		}
+	}
+
+	// Push the dropped bucket records out of the active file so that the
+	// merge sees all of them.
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("filler%d", i), strings.Repeat("f", 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countData(); n != 1 {
+		t.Errorf("expected only app2 data to survive the merge, got %d records", n)
+	}
+	app2, _ = db.Bucket("app2")
+	if v, err := app2.Get("k"); err != nil || v != "two" {
+		t.Errorf("app2 Get(k) after merge = (%q, %v)", v, err)
+	}
+}
@@ -2,12 +2,18 @@ package datastore
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const DefaultMaxSegmentSize = 10 * 1024 * 1024
@@ -16,40 +22,180 @@ var MaxSegmentSize int64 = DefaultMaxSegmentSize
 
 const outFileName = "current-data"
 
+// mergedFileName is the segment being written by a merge.
+const mergedFileName = "merged.dat"
+
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+// ErrClosed is returned by operations on a closed Db.
+var ErrClosed = fmt.Errorf("datastore is closed")
+
 type filePos struct {
 	fileName string
 	offset   int64
+	size     int64
 }
 
 type hashIndex map[string]filePos
 
+type IndexMode int
+
+const (
+	// HashIndexMode keeps the position of every live key in memory.
+	HashIndexMode IndexMode = iota
+	// SparseIndexMode keeps only the keys of the active file in memory and
+	// looks up closed segments through sorted on-disk indexes, trading some
+	// read latency for memory bounded by the segment size.
+	SparseIndexMode
+)
+
+func (m IndexMode) String() string {
+	if m == SparseIndexMode {
+		return "sparse"
+	}
+	return "hash"
+}
+
+// SyncPolicy tells when written records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing to the OS, so a machine crash may lose
+	// acknowledged writes.
+	SyncNone SyncPolicy = iota
+	// SyncAlways flushes the active file before a write is acknowledged.
+	SyncAlways
+	// SyncInterval flushes the active file every Options.SyncInterval,
+	// bounding the writes a machine crash may lose.
+	SyncInterval
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	}
+	return "none"
+}
+
+type Options struct {
+	IndexMode IndexMode
+	// HotKeySampleRate is the fraction of reads and writes whose keys are
+	// counted for Db.HotKeys. Zero disables sampling.
+	HotKeySampleRate float64
+	Sync             SyncPolicy
+	// SyncInterval is the flush period of the SyncInterval policy.
+	SyncInterval time.Duration
+	// BloomFalsePositiveRate is the target rate of the segment filters,
+	// DefaultBloomFalsePositiveRate if zero.
+	BloomFalsePositiveRate float64
+	// HotKeysTracked is the number of most accessed keys kept per
+	// operation, DefaultHotKeysTracked if zero.
+	HotKeysTracked int
+}
+
+func (o Options) bloomFalsePositiveRate() float64 {
+	if o.BloomFalsePositiveRate == 0 {
+		return DefaultBloomFalsePositiveRate
+	}
+	return o.BloomFalsePositiveRate
+}
+
+// segment is a closed, immutable data file.
+type segment struct {
+	path    string
+	size    int64
+	version uint32
+	filter  *bloomFilter
+	sparse  *sparseIndex
+}
+
 type Db struct {
+	opts         Options
 	dir          string
 	out          *os.File
 	outOffset    int64
+	outVersion   uint32
 	segmentIndex int
 	index        hashIndex
 	mu           sync.RWMutex
 	writeCh      chan writeRequest
+	// closing stops the writer, which closes writerDone once it returns.
+	closing    chan struct{}
+	writerDone chan struct{}
+	closeOnce  sync.Once
+	watch      *watchHub
+	// lastSeq is the sequence number of the latest record. Only the writer
+	// assigns new ones.
+	lastSeq atomic.Uint64
+
+	segments       []*segment
+	bloomNegatives atomic.Uint64
+	// filesMu is held by readers while they resolve and read a record, and
+	// exclusively by rotations and merges while they rename and remove data
+	// files. generation, guarded by it, counts those changes, after which
+	// positions taken before may point to another file.
+	filesMu    sync.RWMutex
+	generation uint64
+	// mergeMu serialises merges, which write outside the writer goroutine.
+	mergeMu sync.Mutex
+	// usage holds the live records of every data file, guarded by mu and
+	// kept up to date by the writer. During a merge in sparse mode, shadowed
+	// collects the keys written since the merged segments were taken; only
+	// the writer uses it.
+	usage    map[string]fileUsage
+	shadowed map[string]struct{}
+
+	reads, writes    atomic.Uint64
+	merges           atomic.Uint64
+	mergeTime        atomic.Int64
+	lastMergeTime    atomic.Int64
+	pendingWrites    atomic.Int64
+	recoveryDuration time.Duration
+	hotKeys          *hotKeys
+	stopSync         chan struct{}
+	syncDone         chan struct{}
+
+	// buckets maps bucket names to their ids and secondary holds the
+	// secondary indexes by name, both guarded by mu. metaMu serialises
+	// changes of bucket and index definitions.
+	buckets   map[string]string
+	secondary map[string]*secondaryIndex
+	metaMu    sync.Mutex
 }
 
+// writeRequest carries records that are committed together. A record with
+// an empty value is a tombstone. Requests with fn set run it in the writer
+// instead, between two writes.
 type writeRequest struct {
-	key      string
-	value    string
-	isDelete bool
-	done     chan error
+	records []entry
+	// prepare, when set, builds the records in the writer goroutine, so it
+	// sees the latest state and no other write interleaves.
+	prepare func() ([]entry, error)
+	fn      func() error
+	done    chan error
 }
 
 func Open(dir string) (*Db, error) {
+	return OpenWithOptions(dir, Options{})
+}
+
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, err
 	}
+	start := time.Now()
 
 	db := &Db{
-		dir:   dir,
-		index: make(hashIndex),
+		opts:      opts,
+		dir:       dir,
+		index:     make(hashIndex),
+		watch:     newWatchHub(),
+		hotKeys:   newHotKeys(opts.HotKeySampleRate, opts.HotKeysTracked),
+		buckets:   make(map[string]string),
+		secondary: make(map[string]*secondaryIndex),
 	}
 
 	entries, err := os.ReadDir(dir)
@@ -58,10 +204,16 @@ func Open(dir string) (*Db, error) {
 	}
 	maxIdx := -1
 	for _, entry := range entries {
+		if isShardDir(entry) {
+			return nil, fmt.Errorf("Open: %s contains a sharded datastore", dir)
+		}
 		if entry.IsDir() {
 			continue
 		}
 		var idx int
+		if !strings.HasSuffix(entry.Name(), ".dat") {
+			continue
+		}
 		if n, _ := fmt.Sscanf(entry.Name(), "seg_%d.dat", &idx); n == 1 && idx > maxIdx {
 			maxIdx = idx
 		}
@@ -81,40 +233,90 @@ func Open(dir string) (*Db, error) {
 		return nil, err
 	}
 	db.outOffset = info.Size()
+	if db.outVersion, err = fileFormatVersion(currPath); err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	for i := 0; i <= maxIdx; i++ {
 		segName := filepath.Join(dir, fmt.Sprintf("seg_%d.dat", i))
-		if err := db.recoverFile(segName); err != nil && err != io.EOF {
+		if _, err := os.Stat(segName); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if opts.IndexMode == HashIndexMode {
+			if err := db.recoverFile(segName); err != nil && err != io.EOF {
+				f.Close()
+				return nil, err
+			}
+		}
+		seg, err := db.openSegment(segName, false)
+		if err != nil {
 			f.Close()
 			return nil, err
 		}
+		db.segments = append(db.segments, seg)
 	}
 	if err := db.recoverFile(currPath); err != nil && err != io.EOF {
 		f.Close()
 		return nil, err
 	}
+	// Records are written in the current format, so an active file of an
+	// older version that already holds records becomes a segment.
+	if db.outOffset > 0 && db.outVersion != CurrentFormatVersion {
+		if err := db.rotateSegment(); err != nil {
+			db.out.Close()
+			return nil, fmt.Errorf("Open: %w", err)
+		}
+	}
+
+	if opts.IndexMode == SparseIndexMode {
+		if err := db.recoverSeq(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := db.loadBuckets(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	db.watch.seq = db.lastSeq.Load()
+	if err := db.loadSecondary(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if db.usage, err = db.countUsage(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Open: %w", err)
+	}
 
+	db.recoveryDuration = time.Since(start)
 	db.writeCh = make(chan writeRequest)
+	db.closing, db.writerDone = make(chan struct{}), make(chan struct{})
 	go db.runWriter()
+	if opts.Sync == SyncInterval {
+		if opts.SyncInterval <= 0 {
+			db.Close()
+			return nil, fmt.Errorf("sync interval must be positive, got %v", opts.SyncInterval)
+		}
+		db.stopSync, db.syncDone = make(chan struct{}), make(chan struct{})
+		go db.runSyncer()
+	}
 
 	return db, nil
 }
 
 func (db *Db) recoverFile(path string) error {
-	f, err := os.Open(path)
+	r, err := openSegmentReader(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil
 		}
 		return err
 	}
-	defer f.Close()
+	defer r.close()
 
-	in := bufio.NewReader(f)
-	var offset int64 = 0
 	for {
-		var rec entry
-		n, err := rec.DecodeFromReader(in)
+		rec, offset, err := r.next()
 		if errors.Is(err, io.EOF) {
 			break
 		}
@@ -123,105 +325,579 @@ func (db *Db) recoverFile(path string) error {
 		}
 
 		db.mu.Lock()
-		if rec.value == "" {
+		if rec.value == "" && db.opts.IndexMode == HashIndexMode {
 			delete(db.index, rec.key)
 		} else {
-			db.index[rec.key] = filePos{fileName: path, offset: offset}
+			db.index[rec.key] = filePos{fileName: path, offset: offset, size: r.offset - offset}
 		}
+		db.trackBucket(rec)
 		db.mu.Unlock()
+		db.observeSeq(rec.seq)
+	}
+	return nil
+}
 
-		offset += int64(n)
+func (db *Db) observeSeq(seq uint64) {
+	for cur := db.lastSeq.Load(); seq > cur; cur = db.lastSeq.Load() {
+		if db.lastSeq.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+// recoverSeq restores the last sequence number in sparse mode, where
+// closed segments are not replayed. Segments are numbered in write order
+// and a merge only combines segments older than the following ones, so the
+// newest segment with sequence numbers holds the latest one.
+func (db *Db) recoverSeq() error {
+	if db.lastSeq.Load() != 0 {
+		return nil
+	}
+	for i := len(db.segments) - 1; i >= 0 && db.lastSeq.Load() == 0; i-- {
+		r, err := openSegmentReader(db.segments[i].path)
+		if err != nil {
+			return err
+		}
+		for {
+			rec, _, err := r.next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				r.close()
+				return fmt.Errorf("recoverSeq: %w", err)
+			}
+			db.observeSeq(rec.seq)
+		}
+		r.close()
 	}
 	return nil
 }
 
 func (db *Db) runWriter() {
-	for req := range db.writeCh {
-		e := entry{key: req.key, value: req.value}
-		b := e.Encode()
+	defer close(db.writerDone)
+	for {
+		var req writeRequest
+		select {
+		case req = <-db.writeCh:
+		case <-db.closing:
+			return
+		}
+		if req.fn != nil {
+			req.done <- req.fn()
+			continue
+		}
+		if req.prepare != nil {
+			records, err := req.prepare()
+			if err != nil || len(records) == 0 {
+				req.done <- err
+				continue
+			}
+			req.records = records
+		}
+		// Records may share memory with the caller's batch, so sequence
+		// numbers are assigned to a copy.
+		seq := db.lastSeq.Load()
+		req.records = append([]entry(nil), req.records...)
+		var b []byte
+		for i := range req.records {
+			req.records[i].seq = seq + uint64(i) + 1
+			b = append(b, req.records[i].Encode()...)
+		}
 		toWrite := int64(len(b))
 
-		if db.outOffset+toWrite > MaxSegmentSize {
+		if db.outOffset > 0 && db.outOffset+toWrite > MaxSegmentSize {
 			if err := db.rotateSegment(); err != nil {
 				req.done <- err
 				continue
 			}
 		}
+		currFile := filepath.Join(db.dir, outFileName)
+		replaced, err := db.replacedRecords(req.records, currFile)
+		if err != nil {
+			req.done <- err
+			continue
+		}
+		// The header goes out with the first records, so files without
+		// records stay empty.
+		offset := db.outOffset
+		if db.outOffset == 0 {
+			b = append(segmentHeader(), b...)
+			offset = segmentHeaderSize
+		}
 
+		// The whole request goes out in a single write and becomes visible to
+		// readers under a single lock, so batches are applied atomically.
 		n, err := db.out.Write(b)
 		if err != nil {
 			req.done <- err
 			continue
 		}
+		// The records are in the file even if the flush fails, so they are
+		// indexed anyway and only the error is reported.
+		var syncErr error
+		if db.opts.Sync == SyncAlways {
+			syncErr = db.out.Sync()
+		}
+		db.lastSeq.Store(seq + uint64(len(req.records)))
 
-		currFile := filepath.Join(db.dir, outFileName)
 		db.mu.Lock()
-		if req.isDelete {
-			delete(db.index, req.key)
-		} else {
-			db.index[req.key] = filePos{fileName: currFile, offset: db.outOffset}
+		for i, rec := range req.records {
+			size := int64(len(rec.Encode()))
+			if prev := replaced[i]; prev.live {
+				db.addUsage(prev.file, -1, -prev.size)
+			}
+			if rec.value != "" {
+				db.addUsage(currFile, 1, size)
+			}
+			if db.shadowed != nil {
+				db.shadowed[rec.key] = struct{}{}
+			}
+			if rec.value == "" && db.opts.IndexMode == HashIndexMode {
+				delete(db.index, rec.key)
+			} else {
+				db.index[rec.key] = filePos{fileName: currFile, offset: offset, size: size}
+			}
+			db.trackBucket(rec)
+			db.updateSecondary(rec)
+			offset += size
 		}
+		db.outOffset += int64(n)
 		db.mu.Unlock()
+		db.writes.Add(uint64(len(req.records)))
+		for _, rec := range req.records {
+			db.hotKeys.write(rec.key)
+		}
+		for _, rec := range req.records {
+			db.watch.publish(rec)
+		}
+		for _, rec := range req.records {
+			if err = db.applyIndexDefinition(rec); err != nil {
+				break
+			}
+		}
+		if syncErr != nil {
+			err = syncErr
+		}
+		req.done <- err
+	}
+}
 
-		db.outOffset += int64(n)
-		req.done <- nil
+// runSyncer flushes the active file periodically for the SyncInterval
+// policy. Failed flushes are retried on the next tick.
+func (db *Db) runSyncer() {
+	defer close(db.syncDone)
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stopSync:
+			return
+		case <-ticker.C:
+			_ = db.run(func() error { return db.out.Sync() })
+		}
 	}
 }
 
+func (db *Db) write(records ...entry) error {
+	db.pendingWrites.Add(1)
+	defer db.pendingWrites.Add(-1)
+	return db.send(writeRequest{records: records})
+}
+
+// send hands req to the writer and waits for its result, or fails with
+// ErrClosed once Close was called.
+func (db *Db) send(req writeRequest) error {
+	req.done = make(chan error)
+	select {
+	case db.writeCh <- req:
+		return <-req.done
+	case <-db.closing:
+		return ErrClosed
+	}
+}
+
+// Update atomically replaces the value of key with the one returned by fn,
+// which gets the current value, or found == false for a missing key. An
+// empty value deletes the key and a TTL of the current value is kept. fn
+// runs in the writer goroutine and must not write to the Db itself.
+func (db *Db) Update(key string, fn func(value string, found bool) (string, error)) error {
+	db.pendingWrites.Add(1)
+	defer db.pendingWrites.Add(-1)
+	return db.send(writeRequest{prepare: func() ([]entry, error) {
+		rec, err := db.lookup(key)
+		found := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		value, err := fn(rec.value, found)
+		if err != nil {
+			return nil, err
+		}
+		return []entry{{key: key, value: value, expiresAt: rec.expiresAt, contentType: rec.contentType}}, nil
+	}})
+}
+
+// Ping waits until the writer goroutine takes a request, which it only does
+// between writes.
+func (db *Db) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case db.writeCh <- writeRequest{fn: func() error { return nil }, done: done}:
+	case <-db.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run executes fn in the writer goroutine.
+func (db *Db) run(fn func() error) error {
+	return db.send(writeRequest{fn: fn})
+}
+
 func (db *Db) Put(key, value string) error {
-	done := make(chan error)
-	db.writeCh <- writeRequest{key: key, value: value, isDelete: false, done: done}
-	return <-done
+	return db.write(entry{key: key, value: value})
+}
+
+// PutTTL stores a value that is reported as missing once ttl elapses. The
+// expired record is dropped by the next merge.
+func (db *Db) PutTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.write(entry{key: key, value: value, expiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// Swap stores value with contentType, or deletes key for an empty value,
+// and tells whether key had a live value. The check and the write happen in
+// one step of the writer.
+func (db *Db) Swap(key, value, contentType string) (bool, error) {
+	db.pendingWrites.Add(1)
+	defer db.pendingWrites.Add(-1)
+	var found bool
+	err := db.send(writeRequest{prepare: func() ([]entry, error) {
+		_, err := db.lookup(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		found = err == nil
+		if !found && value == "" {
+			return nil, nil
+		}
+		return []entry{{key: key, value: value, contentType: contentType}}, nil
+	}})
+	return found, err
+}
+
+// PutTyped stores a value with the media type GetTyped returns it with.
+func (db *Db) PutTyped(key, value, contentType string) error {
+	return db.write(entry{key: key, value: value, contentType: contentType})
+}
+
+// PutTypedTTL is PutTyped for a value that expires like one stored by PutTTL.
+func (db *Db) PutTypedTTL(key, value, contentType string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.write(entry{key: key, value: value, contentType: contentType, expiresAt: time.Now().Add(ttl).UnixNano()})
 }
 
 func (db *Db) Delete(key string) error {
-	done := make(chan error)
-	db.writeCh <- writeRequest{key: key, value: "", isDelete: true, done: done}
-	return <-done
+	return db.write(entry{key: key})
+}
+
+// Write applies all operations of the batch atomically.
+func (db *Db) Write(b *Batch) error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.records) == 0 {
+		return nil
+	}
+	return db.write(b.records...)
+}
+
+// Transact runs fn in the writer goroutine, so its reads and the writes it
+// collects happen in one step. fn must not write to the Db itself.
+func (db *Db) Transact(fn func(tx *Txn) error) error {
+	db.pendingWrites.Add(1)
+	defer db.pendingWrites.Add(-1)
+	return db.send(writeRequest{prepare: func() ([]entry, error) {
+		tx := &Txn{get: func(key string) (entry, error) {
+			db.reads.Add(1)
+			db.hotKeys.read(key)
+			return db.lookup(key)
+		}}
+		if err := fn(tx); err != nil {
+			return nil, err
+		}
+		if tx.err != nil {
+			return nil, tx.err
+		}
+		return tx.records, nil
+	}})
 }
 
 func (db *Db) Get(key string) (string, error) {
+	db.reads.Add(1)
+	db.hotKeys.read(key)
+	rec, err := db.lookup(key)
+	return rec.value, err
+}
+
+func (db *Db) GetTyped(key string) (string, string, error) {
+	db.reads.Add(1)
+	db.hotKeys.read(key)
+	rec, err := db.lookup(key)
+	return rec.value, rec.contentType, err
+}
+
+// lookup returns the live record of key.
+func (db *Db) lookup(key string) (entry, error) {
+	db.filesMu.RLock()
+	defer db.filesMu.RUnlock()
+	return db.lookupFiles(key)
+}
+
+// lookupFiles is lookup for callers holding filesMu.
+func (db *Db) lookupFiles(key string) (entry, error) {
+	pos, ok, err := db.locate(key)
+	if err != nil {
+		return entry{}, err
+	}
+	if !ok {
+		return entry{}, ErrNotFound
+	}
+	return readLive(pos)
+}
+
+// locate returns the position of the latest record of key, which may be a
+// tombstone. Callers hold filesMu.
+func (db *Db) locate(key string) (filePos, bool, error) {
 	db.mu.RLock()
 	pos, ok := db.index[key]
+	segments := db.segments
 	db.mu.RUnlock()
+	if ok || db.opts.IndexMode == HashIndexMode {
+		return pos, ok, nil
+	}
+
+	// Newer segments shadow older ones, including with tombstones.
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		if !seg.filter.mayContain(key) {
+			db.bloomNegatives.Add(1)
+			continue
+		}
+		offset, found, err := seg.sparse.find(key)
+		if err != nil {
+			return filePos{}, false, err
+		}
+		if found {
+			return filePos{fileName: seg.path, offset: offset}, true, nil
+		}
+	}
+	return filePos{}, false, nil
+}
+
+// Stat describes the value of key from its record header and trailer,
+// without reading the value itself.
+func (db *Db) Stat(key string) (ValueInfo, error) {
+	db.reads.Add(1)
+	db.hotKeys.read(key)
+	db.filesMu.RLock()
+	defer db.filesMu.RUnlock()
+	pos, ok, err := db.locate(key)
+	if err != nil {
+		return ValueInfo{}, err
+	}
 	if !ok {
-		return "", ErrNotFound
+		return ValueInfo{}, ErrNotFound
 	}
+	return statRecord(pos, key)
+}
 
+// statRecord reads the record of key at pos but its value.
+func statRecord(pos filePos, key string) (ValueInfo, error) {
 	f, err := os.Open(pos.fileName)
 	if err != nil {
-		return "", err
+		return ValueInfo{}, err
 	}
 	defer f.Close()
+	version, err := readFileVersion(f)
+	if err != nil {
+		return ValueInfo{}, err
+	}
 
-	if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
-		return "", err
+	head := make([]byte, len(key)+12)
+	if _, err := f.ReadAt(head, pos.offset); err != nil {
+		return ValueInfo{}, err
+	}
+	size := int64(binary.LittleEndian.Uint32(head))
+	vl := int64(binary.LittleEndian.Uint32(head[len(key)+8:]))
+	trailer := make([]byte, size-vl-int64(len(head)))
+	if _, err := f.ReadAt(trailer, pos.offset+int64(len(head))+vl); err != nil {
+		return ValueInfo{}, err
+	}
+	rec := entry{key: key}
+	rec.decodeTrailer(trailer, version)
+	if vl == 0 || rec.expired(time.Now()) {
+		return ValueInfo{}, ErrNotFound
 	}
+	return rec.info(int(vl)), nil
+}
 
+func readRecord(pos filePos) (entry, error) {
 	var rec entry
-	if _, err := rec.DecodeFromReader(bufio.NewReader(f)); err != nil {
-		return "", err
+	f, err := os.Open(pos.fileName)
+	if err != nil {
+		return rec, err
 	}
-	if rec.value == "" {
-		return "", ErrNotFound
+	defer f.Close()
+	version, err := readFileVersion(f)
+	if err != nil {
+		return rec, err
+	}
+
+	if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
+		return rec, err
 	}
-	return rec.value, nil
+	_, err = rec.decodeFromReader(bufio.NewReader(f), version)
+	return rec, err
+}
+
+// readLive reads the record at pos, reporting tombstones and expired
+// records as ErrNotFound.
+func readLive(pos filePos) (entry, error) {
+	rec, err := readRecord(pos)
+	if err != nil {
+		return entry{}, err
+	}
+	if rec.value == "" || rec.expired(time.Now()) {
+		return entry{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+// Scan calls fn for every live key starting with prefix in ascending key
+// order. Iteration stops at the first error returned by fn.
+func (db *Db) Scan(prefix string, fn func(key, value string) error) error {
+	return db.scan(prefix, func(rec entry) error {
+		return fn(rec.key, rec.value)
+	})
+}
+
+// ScanEvents is Scan with the live records described as put events, which
+// carry their sequence number, expiry time and content type.
+func (db *Db) ScanEvents(prefix string, fn func(ev Event) error) error {
+	return db.scan(prefix, func(rec entry) error {
+		return fn(rec.event())
+	})
+}
+
+func (db *Db) scan(prefix string, fn func(rec entry) error) error {
+	// Records of dropped buckets stay in the log until the next merge. The
+	// live ids are read again for buckets created during the scan.
+	live := db.liveBucketIDs()
+	visible := fn
+	fn = func(rec entry) error {
+		if deadBucketKey(rec.key, live) {
+			if live = db.liveBucketIDs(); deadBucketKey(rec.key, live) {
+				return nil
+			}
+		}
+		return visible(rec)
+	}
+	if db.opts.IndexMode == SparseIndexMode {
+		return db.scanSparse(prefix, fn)
+	}
+
+	db.filesMu.RLock()
+	gen := db.generation
+	db.mu.RLock()
+	keys := make([]string, 0, len(db.index))
+	positions := make(map[string]filePos)
+	for key, pos := range db.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			positions[key] = pos
+		}
+	}
+	db.mu.RUnlock()
+	db.filesMu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rec, err := db.readScanned(key, positions[key], gen)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readScanned reads the record of key at pos, taken by a scan at generation
+// gen. After a rotation or merge pos may be stale, so key is looked up again.
+func (db *Db) readScanned(key string, pos filePos, gen uint64) (entry, error) {
+	db.filesMu.RLock()
+	defer db.filesMu.RUnlock()
+	if db.generation != gen {
+		return db.lookupFiles(key)
+	}
+	return readLive(pos)
 }
 
 func (db *Db) Size() (int64, error) {
-	info, err := db.out.Stat()
+	db.mu.RLock()
+	out := db.out
+	db.mu.RUnlock()
+	info, err := out.Stat()
 	if err != nil {
 		return 0, err
 	}
 	return info.Size(), nil
 }
 
+// Close waits for the write in progress, if any, and closes the files.
+// Later writes fail with ErrClosed, and so does closing again.
 func (db *Db) Close() error {
-	close(db.writeCh)
+	closed := false
+	db.closeOnce.Do(func() { closed = true })
+	if !closed {
+		return ErrClosed
+	}
+	if db.stopSync != nil {
+		close(db.stopSync)
+		<-db.syncDone
+	}
+	close(db.closing)
+	<-db.writerDone
+	db.watch.close()
+	if db.opts.Sync != SyncNone {
+		if err := db.out.Sync(); err != nil {
+			db.out.Close()
+			return err
+		}
+	}
 	return db.out.Close()
 }
 
 func (db *Db) rotateSegment() error {
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+	db.generation++
 	if err := db.out.Close(); err != nil {
 		return err
 	}
@@ -232,13 +908,80 @@ func (db *Db) rotateSegment() error {
 		return err
 	}
 
+	db.mu.Lock()
+	for key, pos := range db.index {
+		if pos.fileName == oldPath {
+			pos.fileName = newPath
+			db.index[key] = pos
+		}
+	}
+	if u, ok := db.usage[oldPath]; ok {
+		db.usage[newPath] = u
+		delete(db.usage, oldPath)
+	}
+	db.mu.Unlock()
+
 	db.segmentIndex++
 
 	f, err := os.OpenFile(oldPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
 	if err != nil {
 		return err
 	}
+	db.mu.Lock()
 	db.out = f
 	db.outOffset = 0
+	db.outVersion = CurrentFormatVersion
+	db.mu.Unlock()
+
+	seg, err := db.openSegment(newPath, true)
+	if err != nil {
+		return fmt.Errorf("rotateSegment: %w", err)
+	}
+	db.mu.Lock()
+	db.segments = append(db.segments, seg)
+	if db.opts.IndexMode == SparseIndexMode {
+		for key, pos := range db.index {
+			if pos.fileName == newPath {
+				delete(db.index, key)
+			}
+		}
+	}
+	db.mu.Unlock()
 	return nil
 }
+
+// openSegment loads the filter and the on-disk index of a closed segment in
+// sparse mode. With rebuild set both are created from the segment data. In
+// hash mode the in-memory index answers every lookup, so segments have
+// neither.
+func (db *Db) openSegment(path string, rebuild bool) (*segment, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{path: path, size: info.Size()}
+	if seg.version, err = fileFormatVersion(path); err != nil {
+		return nil, err
+	}
+	if db.opts.IndexMode != SparseIndexMode {
+		return seg, nil
+	}
+
+	if rebuild {
+		seg.filter, err = buildSegmentFilter(path, db.opts.bloomFalsePositiveRate())
+	} else {
+		seg.filter, err = loadSegmentFilter(path, db.opts.bloomFalsePositiveRate())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rebuild {
+		seg.sparse, err = buildSegmentIndex(path)
+	} else {
+		seg.sparse, err = loadSegmentIndex(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
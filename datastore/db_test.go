@@ -1,6 +1,7 @@
 package datastore
 
 import (
+  "strings"
   "testing"
 )
 
@@ -106,3 +107,34 @@ func TestDb(t *testing.T) {
     }
   })
 }
+
+func TestDb_Scan(t *testing.T) {
+  db, err := Open(t.TempDir())
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    _ = db.Close()
+  })
+
+  for _, pair := range [][]string{{"b/2", "x"}, {"a/1", "y"}, {"b/1", "z"}, {"b/3", "w"}} {
+    if err := db.Put(pair[0], pair[1]); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := db.Delete("b/3"); err != nil {
+    t.Fatal(err)
+  }
+
+  var got []string
+  err = db.Scan("b/", func(key, value string) error {
+    got = append(got, key+"="+value)
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if strings.Join(got, ",") != "b/1=z,b/2=x" {
+    t.Errorf("unexpected scan result %v", got)
+  }
+}
@@ -6,31 +6,95 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 type entry struct {
 	key, value string
+	// expiresAt is a Unix time in nanoseconds, zero for records without TTL.
+	expiresAt int64
+	// seq is the global sequence number assigned by the writer, zero for
+	// records written before sequence numbers were introduced.
+	seq uint64
+	// contentType is the media type the value was stored with, empty for
+	// values written without one.
+	contentType string
 }
 
-// 0           4    8     kl+8  kl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)
-// 4           4    ....  4     .....     <-- length
+// 0           4    8     kl+8  kl+12     kl+vl+12   <-- offset
+// (full size) (kl) (key) (vl)  (value)   (trailer)
+// 4           4    ....  4     .....     0, 8 or 16 <-- length
+//
+// The format version of the file and the trailer length tell its layout:
+//
+//	0:  no sequence number, no TTL
+//	8:  (expiresAt), without a sequence number
+//	16: (seq) (expiresAt), expiresAt being zero for records without TTL,
+//	    from version 2 on
+//	20+: (seq) (expiresAt) (type length) (content type), from version 3 on
 
 func (e *entry) Encode() []byte {
 	kl, vl := len(e.key), len(e.value)
 	size := kl + vl + 12
+	if e.contentType != "" {
+		size += 20 + len(e.contentType)
+	} else if e.seq != 0 {
+		size += 16
+	} else if e.expiresAt != 0 {
+		size += 8
+	}
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
 	copy(res[kl+12:], e.value)
+	trailer := res[kl+vl+12:]
+	if len(trailer) >= 16 {
+		binary.LittleEndian.PutUint64(trailer, e.seq)
+		trailer = trailer[8:]
+	}
+	if len(trailer) > 0 {
+		binary.LittleEndian.PutUint64(trailer, uint64(e.expiresAt))
+		trailer = trailer[8:]
+	}
+	if len(trailer) > 0 {
+		binary.LittleEndian.PutUint32(trailer, uint32(len(e.contentType)))
+		copy(trailer[4:], e.contentType)
+	}
 	return res
 }
 
+// Decode decodes a record of the current format version.
 func (e *entry) Decode(input []byte) {
+	e.decode(input, CurrentFormatVersion)
+}
+
+func (e *entry) decode(input []byte, version uint32) {
 	e.key = decodeString(input[4:])
 	e.value = decodeString(input[len(e.key)+8:])
+	e.decodeTrailer(input[len(e.key)+len(e.value)+12:], version)
+}
+
+// decodeTrailer reads the trailer fields that format version defines.
+// Versions 0 and 1 only know the expiry time.
+func (e *entry) decodeTrailer(trailer []byte, version uint32) {
+	e.expiresAt, e.seq, e.contentType = 0, 0, ""
+	if version >= 2 && len(trailer) >= 16 {
+		e.seq = binary.LittleEndian.Uint64(trailer)
+		trailer = trailer[8:]
+	}
+	if len(trailer) >= 8 {
+		e.expiresAt = int64(binary.LittleEndian.Uint64(trailer))
+		trailer = trailer[8:]
+	}
+	if version >= 3 && len(trailer) >= 4 {
+		e.contentType = decodeString(trailer)
+	}
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.expiresAt != 0 && now.UnixNano() >= e.expiresAt
 }
 
 func decodeString(v []byte) string {
@@ -40,7 +104,12 @@ func decodeString(v []byte) string {
 	return string(buf)
 }
 
+// DecodeFromReader decodes a record of the current format version.
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	return e.decodeFromReader(in, CurrentFormatVersion)
+}
+
+func (e *entry) decodeFromReader(in *bufio.Reader, version uint32) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -49,10 +118,10 @@ func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
 	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
-	e.Decode(buf)
+	e.decode(buf, version)
 	return n, nil
 }
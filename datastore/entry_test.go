@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"testing"
+	"time"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -21,7 +22,7 @@ func TestReadValue(t *testing.T) {
 	var (
 		a, b entry
 	)
-	a = entry{"key", "test-value"}
+	a = entry{key: "key", value: "test-value"}
 	originalBytes := a.Encode()
 
 	b.Decode(originalBytes)
@@ -43,3 +44,48 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(originalBytes))
 	}
 }
+
+func TestEntry_ExpiresAt(t *testing.T) {
+	a := entry{key: "key", value: "value", expiresAt: 1234567890}
+	var b entry
+	b.Decode(a.Encode())
+	if a != b {
+		t.Errorf("Encode/Decode mismatch: %v != %v", a, b)
+	}
+	if !a.expired(time.Unix(0, 1234567890)) || a.expired(time.Unix(0, 1234567889)) {
+		t.Error("incorrect expiration check")
+	}
+
+	plain := entry{key: "key", value: "value"}
+	if len(plain.Encode()) != 20 {
+		t.Errorf("records without TTL must keep the original layout, got %d bytes", len(plain.Encode()))
+	}
+}
+
+func TestEntry_Seq(t *testing.T) {
+	for _, a := range []entry{
+		{key: "key", value: "value", seq: 42},
+		{key: "key", value: "value", seq: 42, expiresAt: 1234567890},
+		{key: "key", seq: 43},
+	} {
+		var b entry
+		b.Decode(a.Encode())
+		if a != b {
+			t.Errorf("Encode/Decode mismatch: %v != %v", a, b)
+		}
+	}
+}
+
+func TestEntry_ContentType(t *testing.T) {
+	for _, a := range []entry{
+		{key: "key", value: "\x00\xff", seq: 42, contentType: "application/octet-stream"},
+		{key: "key", value: "v", expiresAt: 1234567890, contentType: "text/plain"},
+		{key: "key", value: "v", contentType: "image/png"},
+	} {
+		var b entry
+		b.Decode(a.Encode())
+		if a != b {
+			t.Errorf("Encode/Decode mismatch: %v != %v", a, b)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// ExportVersion is the version of the JSON Lines export format written by
+// Export. Import accepts records of this and earlier versions.
+const ExportVersion = 2
+
+const DefaultImportBatchSize = 1000
+
+// ImportBatchSize is the number of records Import writes in one batch.
+var ImportBatchSize = DefaultImportBatchSize
+
+var ErrUnsupportedExport = fmt.Errorf("unsupported export format version")
+
+// ErrImportNotEmpty rejects internal records, e.g. bucket metadata, imported
+// into a store that already has records: the bucket ids of the export could
+// collide with its own.
+var ErrImportNotEmpty = fmt.Errorf("internal records can only be imported into an empty store")
+
+// ExportRecord is a single line of the export format. Records without
+// ExpiresAt never expire, and a missing Version means version 1. Seq is the
+// sequence number of the record in the exported store; Import assigns new
+// ones. Values that are not valid UTF-8 are kept in Data, which JSON
+// encodes as base64, instead of Value.
+type ExportRecord struct {
+	Key         string    `json:"key"`
+	Value       string    `json:"value,omitempty"`
+	Data        []byte    `json:"data,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt,omitzero"`
+	Seq         uint64    `json:"seq,omitempty"`
+	Version     int       `json:"version,omitempty"`
+}
+
+// Export writes every live record, internal bucket and index metadata
+// included, as JSON Lines in ascending key order and returns the number of
+// records written.
+func (db *Db) Export(w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	err := db.scan("", func(rec entry) error {
+		er := ExportRecord{Key: rec.key, ContentType: rec.contentType, Seq: rec.seq, Version: ExportVersion}
+		if utf8.ValidString(rec.value) {
+			er.Value = rec.value
+		} else {
+			er.Data = []byte(rec.value)
+		}
+		if rec.expiresAt != 0 {
+			er.ExpiresAt = time.Unix(0, rec.expiresAt).UTC()
+		}
+		if err := enc.Encode(er); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Import reads records written by Export and stores them in batches of
+// ImportBatchSize. Records that have already expired are skipped. Internal
+// records fail with ErrImportNotEmpty unless the store was empty. Batches
+// written before an error stay in place; the returned count says how many
+// records were stored.
+func (db *Db) Import(r io.Reader) (int, error) {
+	empty, err := db.empty()
+	if err != nil {
+		return 0, err
+	}
+	dec := json.NewDecoder(r)
+	var b Batch
+	n, line := 0, 0
+	flush := func() error {
+		if err := db.Write(&b); err != nil {
+			return err
+		}
+		n += b.Len()
+		b = Batch{}
+		return nil
+	}
+
+	now := time.Now()
+	for {
+		var er ExportRecord
+		err := dec.Decode(&er)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		line++
+		if err != nil {
+			return n, fmt.Errorf("import record %d: %w", line, err)
+		}
+		if er.Version > ExportVersion {
+			return n, fmt.Errorf("import record %d: %w %d", line, ErrUnsupportedExport, er.Version)
+		}
+		if er.Data != nil {
+			er.Value = string(er.Data)
+		}
+		if er.Key == "" || er.Value == "" {
+			return n, fmt.Errorf("import record %d: key and value must not be empty", line)
+		}
+		if IsInternalKey(er.Key) && !empty {
+			return n, fmt.Errorf("import record %d: %w", line, ErrImportNotEmpty)
+		}
+
+		rec := entry{key: er.Key, value: er.Value, contentType: er.ContentType}
+		if !er.ExpiresAt.IsZero() {
+			if !er.ExpiresAt.After(now) {
+				continue
+			}
+			rec.expiresAt = er.ExpiresAt.UnixNano()
+		}
+		b.records = append(b.records, rec)
+		if b.Len() >= ImportBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// empty tells whether the store has no live record, internal ones included.
+func (db *Db) empty() (bool, error) {
+	errFound := errors.New("found")
+	err := db.scan("", func(entry) error { return errFound })
+	if errors.Is(err, errFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,189 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	saved := ImportBatchSize
+	ImportBatchSize = 3
+	t.Cleanup(func() { ImportBatchSize = saved })
+
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = src.Close() })
+
+	for i := 0; i < 10; i++ {
+		if err := src.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.PutTTL("temp", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CreateBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := src.Bucket("users")
+	if err := users.Put("alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := src.Export(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 9 keys, temp, the bucket, its id counter and alice.
+	if lines := strings.Count(buf.String(), "\n"); n != 13 || lines != n {
+		t.Fatalf("exported %d records in %d lines, expected 13", n, lines)
+	}
+
+	dst, err := OpenWithOptions(t.TempDir(), Options{IndexMode: SparseIndexMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dst.Close() })
+	if n, err := dst.Import(&buf); err != nil || n != 13 {
+		t.Fatalf("Import() = %d, %v", n, err)
+	}
+
+	if _, err := dst.Get("key0"); err != ErrNotFound {
+		t.Errorf("deleted key was imported")
+	}
+	if v, err := dst.Get("key9"); err != nil || v != "value9" {
+		t.Errorf("Get(key9) = %q, %v", v, err)
+	}
+	users, err = dst.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := users.Get("alice"); err != nil || v != "admin" {
+		t.Errorf("bucket key was not imported: %q, %v", v, err)
+	}
+
+	var out bytes.Buffer
+	if _, err := dst.Export(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"key":"temp","value":"v","expiresAt":"`) {
+		t.Errorf("TTL was not preserved:\n%s", out.String())
+	}
+}
+
+func TestImport_NonEmpty(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = src.Close() })
+	if err := src.CreateBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := src.Bucket("users")
+	if err := users.Put("alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put("plain", "v"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dst.Close() })
+	// The bucket of dst takes the id the export gives users.
+	if err := dst.CreateBucket("admins"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dst.Import(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrImportNotEmpty) || n != 0 {
+		t.Fatalf("Import() = %d, %v", n, err)
+	}
+	if got := dst.Buckets(); len(got) != 1 || got[0] != "admins" {
+		t.Errorf("buckets after a rejected import: %v", got)
+	}
+
+	// Plain records can be imported anywhere.
+	if n, err := dst.Import(strings.NewReader(`{"key":"plain","value":"v"}`)); err != nil || n != 1 {
+		t.Errorf("Import() of a plain record = %d, %v", n, err)
+	}
+}
+
+func TestExportImport_Binary(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = src.Close() })
+
+	blob := "\x00\xff\xfe binary"
+	if err := src.PutTyped("blob", blob, "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"data":"AP/+IGJpbmFyeQ==","contentType":"application/octet-stream"`) {
+		t.Fatalf("binary value not exported as data:\n%s", buf.String())
+	}
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dst.Close() })
+	if _, err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v, ct, err := dst.GetTyped("blob"); err != nil || v != blob || ct != "application/octet-stream" {
+		t.Errorf("GetTyped(blob) = %q, %q, %v", v, ct, err)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	in := `{"key":"a","value":"1"}
+{"key":"old","value":"x","expiresAt":"2000-01-01T00:00:00Z"}
+{"key":"b","value":"2","version":99}
+`
+	n, err := db.Import(strings.NewReader(in))
+	if !errors.Is(err, ErrUnsupportedExport) {
+		t.Errorf("expected ErrUnsupportedExport, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("expected no records before the first full batch, got %d", n)
+	}
+
+	n, err = db.Import(strings.NewReader(in[:strings.LastIndex(in[:len(in)-1], "\n")+1]))
+	if err != nil || n != 1 {
+		t.Errorf("Import() = %d, %v", n, err)
+	}
+	if _, err := db.Get("old"); err != ErrNotFound {
+		t.Errorf("expired record was imported")
+	}
+
+	if _, err := db.Import(strings.NewReader(`{"key":"a"`)); err == nil {
+		t.Errorf("expected an error for malformed input")
+	}
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Data files written by this version start with a header:
+//
+// 0       4         <-- offset
+// (magic) (version)
+// 4       4         <-- length
+//
+// Files of format version 0 predate the header and start with the first
+// record. Its size field is never as large as the magic read as a little
+// endian number, which tells the two apart. Record offsets are always
+// relative to the start of the file, header included.
+//
+// Version 2 adds sequence numbers to record trailers and version 3 content
+// types. Trailers are decoded by the version of their file, and the active
+// file is rotated on open when it has an older version, so that files never
+// mix versions.
+const (
+	segmentMagic      = "\x89KVS"
+	segmentHeaderSize = 8
+
+	legacyFormatVersion  = 0
+	CurrentFormatVersion = 3
+)
+
+var ErrUnsupportedFormat = fmt.Errorf("unsupported data file format version")
+
+func segmentHeader() []byte {
+	h := make([]byte, segmentHeaderSize)
+	copy(h, segmentMagic)
+	binary.LittleEndian.PutUint32(h[4:], CurrentFormatVersion)
+	return h
+}
+
+// segmentReader reads the records of a data file in order, whatever its
+// format version.
+type segmentReader struct {
+	f       *os.File
+	in      *bufio.Reader
+	version uint32
+	offset  int64
+}
+
+func openSegmentReader(path string) (*segmentReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &segmentReader{f: f, in: bufio.NewReader(f)}
+	if r.version, err = readFormatVersion(r.in); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if r.version != legacyFormatVersion {
+		r.offset = segmentHeaderSize
+	}
+	return r, nil
+}
+
+// readFormatVersion consumes the header if in has one. Empty files report
+// the current version.
+func readFormatVersion(in *bufio.Reader) (uint32, error) {
+	h, err := in.Peek(segmentHeaderSize)
+	if len(h) == 0 && errors.Is(err, io.EOF) {
+		return CurrentFormatVersion, nil
+	}
+	if len(h) < 4 || string(h[:4]) != segmentMagic {
+		return legacyFormatVersion, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read header: %w", err)
+	}
+	version := binary.LittleEndian.Uint32(h[4:])
+	if version > CurrentFormatVersion {
+		return 0, fmt.Errorf("%w %d", ErrUnsupportedFormat, version)
+	}
+	_, err = in.Discard(segmentHeaderSize)
+	return version, err
+}
+
+// readFileVersion returns the format version of the open data file f
+// without moving its offset.
+func readFileVersion(f *os.File) (uint32, error) {
+	return readFormatVersion(bufio.NewReader(io.NewSectionReader(f, 0, segmentHeaderSize)))
+}
+
+// next returns the next record with its offset, or io.EOF at the end of the
+// file.
+func (r *segmentReader) next() (entry, int64, error) {
+	var rec entry
+	var n int
+	var err error
+	switch r.version {
+	case legacyFormatVersion, 1, 2, CurrentFormatVersion:
+		// Versions share the record layout and differ in their trailers,
+		// see entry.decodeTrailer.
+		n, err = rec.decodeFromReader(r.in, r.version)
+	default:
+		err = fmt.Errorf("%w %d", ErrUnsupportedFormat, r.version)
+	}
+	if err != nil {
+		return rec, 0, err
+	}
+	offset := r.offset
+	r.offset += int64(n)
+	return rec, offset, nil
+}
+
+func (r *segmentReader) close() error {
+	return r.f.Close()
+}
+
+// fileFormatVersion returns the format version of the data file at path.
+func fileFormatVersion(path string) (uint32, error) {
+	r, err := openSegmentReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.close()
+	return r.version, nil
+}
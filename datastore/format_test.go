@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLegacyFile writes records in format version 0, without a header.
+func writeLegacyFile(t *testing.T, path string, records ...entry) {
+	t.Helper()
+	var b []byte
+	for _, rec := range records {
+		b = append(b, rec.Encode()...)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			var old []entry
+			for i := 0; i < 10; i++ {
+				old = append(old, entry{key: fmt.Sprintf("key%d", i), value: fmt.Sprintf("old%d", i)})
+			}
+			writeLegacyFile(t, filepath.Join(dir, "seg_0.dat"), old[:5]...)
+			writeLegacyFile(t, filepath.Join(dir, "seg_1.dat"), old[5:]...)
+			writeLegacyFile(t, filepath.Join(dir, outFileName), entry{key: "key0", value: "new0"})
+
+			db, err := OpenWithOptions(dir, Options{IndexMode: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+
+			check := func() {
+				t.Helper()
+				if v, err := db.Get("key0"); err != nil || v != "new0" {
+					t.Errorf("Get(key0) = %q, %v", v, err)
+				}
+				if v, err := db.Get("key7"); err != nil || v != "old7" {
+					t.Errorf("Get(key7) = %q, %v", v, err)
+				}
+			}
+			check()
+			// The active legacy file holds records, so it became a segment.
+			for _, seg := range db.Stats().Segments {
+				want := uint32(legacyFormatVersion)
+				if seg.Name == outFileName {
+					want = CurrentFormatVersion
+				}
+				if seg.FormatVersion != want {
+					t.Errorf("segment %s reports format version %d", seg.Name, seg.FormatVersion)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "seg_2.dat")); err != nil {
+				t.Errorf("the active legacy file was not rotated: %v", err)
+			}
+
+			if err := db.Put("key1", "new1"); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, outFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data[:4]) != segmentMagic {
+				t.Errorf("new records were written without a header")
+			}
+			if err := db.MergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			check()
+			st := db.Stats()
+			if len(st.Segments) != 1 || st.Segments[0].FormatVersion != CurrentFormatVersion {
+				t.Errorf("merge did not upgrade the segments: %+v", st.Segments)
+			}
+			data, err = os.ReadFile(filepath.Join(dir, "seg_0.dat"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data[:4]) != segmentMagic {
+				t.Errorf("merged segment has no header")
+			}
+		})
+	}
+}
+
+func TestSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := db.Size(); size != 0 {
+		t.Errorf("expected an empty active file, got %d bytes", size)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:4]) != segmentMagic || binary.LittleEndian.Uint32(data[4:]) != CurrentFormatVersion {
+		t.Fatalf("unexpected header %q", data[:segmentHeaderSize])
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("key"); err != nil || v != "value" {
+		t.Errorf("Get(key) = %q, %v", v, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	binary.LittleEndian.PutUint32(data[4:], CurrentFormatVersion+1)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestDecodeTrailerByVersion(t *testing.T) {
+	typed := entry{key: "k", value: "v", seq: 7, expiresAt: 42, contentType: "text/plain"}
+	for _, tc := range []struct {
+		version uint32
+		want    entry
+	}{
+		{CurrentFormatVersion, typed},
+		{2, entry{key: "k", value: "v", seq: 7, expiresAt: 42}},
+		{1, entry{key: "k", value: "v", expiresAt: 7}},
+	} {
+		var got entry
+		got.decode(typed.Encode(), tc.version)
+		if got != tc.want {
+			t.Errorf("version %d: decoded %+v, want %+v", tc.version, got, tc.want)
+		}
+	}
+}
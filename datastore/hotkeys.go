@@ -0,0 +1,176 @@
+package datastore
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHotKeysTracked = 100
+
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+type KeyCount struct {
+	Key string `json:"key"`
+	// Count is the estimated number of accesses, scaled by the sampling
+	// rate.
+	Count uint64 `json:"count"`
+}
+
+type HotKeys struct {
+	SampleRate float64    `json:"sampleRate"`
+	Since      time.Time  `json:"since"`
+	Reads      []KeyCount `json:"reads"`
+	Writes     []KeyCount `json:"writes"`
+}
+
+// HotKeyReporter is implemented by stores that can sample key accesses.
+type HotKeyReporter interface {
+	HotKeys(n int) (HotKeys, bool)
+	ResetHotKeys()
+}
+
+var (
+	_ HotKeyReporter = (*Db)(nil)
+	_ HotKeyReporter = (*ShardedDb)(nil)
+)
+
+// keyTracker estimates access counts of sampled keys with a count-min sketch
+// and keeps the keys with the highest estimates.
+type keyTracker struct {
+	sketch [sketchDepth][sketchWidth]uint32
+	top    map[string]uint32
+	limit  int
+}
+
+func newKeyTracker(limit int) *keyTracker {
+	return &keyTracker{top: make(map[string]uint32), limit: limit}
+}
+
+func (t *keyTracker) add(key string) {
+	h1, h2 := doubleHash(key)
+	estimate := ^uint32(0)
+	for i := uint64(0); i < sketchDepth; i++ {
+		c := &t.sketch[i][(h1+i*h2)%sketchWidth]
+		*c++
+		estimate = min(estimate, *c)
+	}
+
+	if _, ok := t.top[key]; ok || len(t.top) < t.limit {
+		t.top[key] = estimate
+		return
+	}
+	minKey, minCount := "", ^uint32(0)
+	for k, c := range t.top {
+		if c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	if estimate > minCount {
+		delete(t.top, minKey)
+		t.top[key] = estimate
+	}
+}
+
+func (t *keyTracker) list(n int, rate float64) []KeyCount {
+	res := make([]KeyCount, 0, len(t.top))
+	for key, c := range t.top {
+		res = append(res, KeyCount{Key: key, Count: uint64(float64(c) / rate)})
+	}
+	return topKeys(res, n)
+}
+
+// topKeys sorts counts by decreasing count and keeps the first n, all of
+// them if n is not positive.
+func topKeys(counts []KeyCount, n int) []KeyCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// hotKeys samples reads and writes when Options.HotKeySampleRate is set.
+type hotKeys struct {
+	rate    float64
+	tracked int
+	mu      sync.Mutex
+	since   time.Time
+	reads   *keyTracker
+	writes  *keyTracker
+}
+
+func newHotKeys(rate float64, tracked int) *hotKeys {
+	if rate <= 0 {
+		return nil
+	}
+	if tracked <= 0 {
+		tracked = DefaultHotKeysTracked
+	}
+	h := &hotKeys{rate: min(rate, 1), tracked: tracked}
+	h.reset()
+	return h
+}
+
+func (h *hotKeys) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.since = time.Now()
+	h.reads = newKeyTracker(h.tracked)
+	h.writes = newKeyTracker(h.tracked)
+}
+
+func (h *hotKeys) sample() bool {
+	return h != nil && (h.rate >= 1 || rand.Float64() < h.rate)
+}
+
+func (h *hotKeys) read(key string) {
+	if !h.sample() {
+		return
+	}
+	h.mu.Lock()
+	h.reads.add(key)
+	h.mu.Unlock()
+}
+
+func (h *hotKeys) write(key string) {
+	if !h.sample() {
+		return
+	}
+	h.mu.Lock()
+	h.writes.add(key)
+	h.mu.Unlock()
+}
+
+// HotKeys returns up to n of the most read and written keys since the
+// database was opened or ResetHotKeys was called. It reports false when
+// sampling is disabled.
+func (db *Db) HotKeys(n int) (HotKeys, bool) {
+	h := db.hotKeys
+	if h == nil {
+		return HotKeys{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HotKeys{
+		SampleRate: h.rate,
+		Since:      h.since,
+		Reads:      h.reads.list(n, h.rate),
+		Writes:     h.writes.list(n, h.rate),
+	}, true
+}
+
+func (db *Db) ResetHotKeys() {
+	if db.hotKeys != nil {
+		db.hotKeys.reset()
+	}
+}
@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHotKeys(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{HotKeySampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	for i := 0; i < 200; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b Batch
+	for i := 0; i < 50; i++ {
+		b.Put("counter", fmt.Sprint(i))
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i%200)
+		if i%2 == 0 {
+			key = "key7"
+		}
+		_, _ = db.Get(key)
+	}
+
+	hot, ok := db.HotKeys(3)
+	if !ok {
+		t.Fatal("sampling is not enabled")
+	}
+	if len(hot.Reads) != 3 || hot.Reads[0] != (KeyCount{Key: "key7", Count: 505}) {
+		t.Errorf("unexpected hot reads %+v", hot.Reads)
+	}
+	if len(hot.Writes) != 3 || hot.Writes[0] != (KeyCount{Key: "counter", Count: 50}) {
+		t.Errorf("unexpected hot writes %+v", hot.Writes)
+	}
+
+	db.ResetHotKeys()
+	if hot, _ := db.HotKeys(3); len(hot.Reads) != 0 || len(hot.Writes) != 0 {
+		t.Errorf("reset kept %+v", hot)
+	}
+}
+
+func TestHotKeysDisabled(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Put("key", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.HotKeys(10); ok {
+		t.Error("hot keys reported without sampling")
+	}
+}
+
+func TestKeyTrackerKeepsHeavyHitters(t *testing.T) {
+	tr := newKeyTracker(5)
+	for i := 0; i < 10000; i++ {
+		tr.add(fmt.Sprintf("cold%d", i))
+		if i%10 == 0 {
+			tr.add("hot")
+		}
+	}
+	top := tr.list(1, 1)
+	if len(top) != 1 || top[0].Key != "hot" || top[0].Count < 1000 {
+		t.Errorf("unexpected top keys %+v", top)
+	}
+}
+
+func TestHotKeysTracked(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{HotKeySampleRate: 1, HotKeysTracked: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hot, _ := db.HotKeys(0); len(hot.Writes) != 3 {
+		t.Errorf("HotKeys(0) tracked %d written keys, expected 3", len(hot.Writes))
+	}
+}
+
+func TestShardedHotKeys(t *testing.T) {
+	db, err := OpenSharded(t.TempDir(), 4, Options{HotKeySampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	for i := 0; i < 20; i++ {
+		for j := 0; j <= i; j++ {
+			if err := db.Put(fmt.Sprintf("key%02d", i), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hot, ok := db.HotKeys(2)
+	if !ok {
+		t.Fatal("sampling is not enabled")
+	}
+	want := []KeyCount{{Key: "key19", Count: 20}, {Key: "key18", Count: 19}}
+	if len(hot.Writes) != 2 || hot.Writes[0] != want[0] || hot.Writes[1] != want[1] {
+		t.Errorf("HotKeys(2).Writes = %+v, expected %+v", hot.Writes, want)
+	}
+}
@@ -0,0 +1,850 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultLSMMemtableSize  = 4 * 1024 * 1024
+	DefaultLSMTableSize     = 2 * 1024 * 1024
+	DefaultLSML0Tables      = 4
+	DefaultLSMLevelBaseSize = 10 * 1024 * 1024
+	DefaultLSMLevelRatio    = 10
+)
+
+var (
+	LSMMemtableSize  int64 = DefaultLSMMemtableSize
+	LSMTableSize     int64 = DefaultLSMTableSize
+	LSML0Tables            = DefaultLSML0Tables
+	LSMLevelBaseSize int64 = DefaultLSMLevelBaseSize
+	LSMLevelRatio    int64 = DefaultLSMLevelRatio
+)
+
+const (
+	lsmWalName      = "wal.log"
+	lsmManifestName = "MANIFEST"
+)
+
+type table struct {
+	*segment
+}
+
+// keyRange returns the smallest and the largest key of the table.
+func (t *table) keyRange() (string, string) {
+	if len(t.sparse.summary) == 0 {
+		return "", ""
+	}
+	return t.sparse.summary[0].key, t.sparse.last
+}
+
+func (t *table) overlaps(first, last string) bool {
+	tfirst, tlast := t.keyRange()
+	return tfirst <= last && first <= tlast
+}
+
+type lsmManifest struct {
+	NextTable int        `json:"nextTable"`
+	Levels    [][]string `json:"levels"`
+}
+
+// LSMStore is a storage engine built of an in-memory memtable backed by a
+// write-ahead log and sorted string tables organised in levels. Level 0
+// holds flushed memtables that may overlap; deeper levels hold tables with
+// disjoint key ranges produced by compaction, which runs in the background.
+type LSMStore struct {
+	dir  string
+	opts Options
+
+	mu        sync.RWMutex
+	wal       *os.File
+	memtable  map[string]string
+	memSize   int64
+	levels    [][]*table
+	nextTable int
+	closed    bool
+	// cursors holds, per level, the last key compacted out of the level, so
+	// that its tables take turns.
+	cursors []string
+
+	// compactCh wakes the compactor after a flush. closing stops it and
+	// compactorDone is closed once it returns.
+	compactCh     chan struct{}
+	closing       chan struct{}
+	compactorDone chan struct{}
+	compactErr    error
+
+	bloomNegatives atomic.Uint64
+	reads, writes  atomic.Uint64
+}
+
+func OpenLSM(dir string) (*LSMStore, error) {
+	return OpenLSMWithOptions(dir, Options{})
+}
+
+// OpenLSMWithOptions opens the store with the bloom filter rate of opts. The
+// other options concern the log engine only.
+func OpenLSMWithOptions(dir string, opts Options) (*LSMStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &LSMStore{
+		dir:           dir,
+		opts:          opts,
+		memtable:      make(map[string]string),
+		compactCh:     make(chan struct{}, 1),
+		closing:       make(chan struct{}),
+		compactorDone: make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, lsmManifestName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var m lsmManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("OpenLSM: bad manifest: %w", err)
+		}
+		s.nextTable = m.NextTable
+		for level, names := range m.Levels {
+			for _, name := range names {
+				t, err := s.openTable(filepath.Join(dir, name), false)
+				if err != nil {
+					return nil, fmt.Errorf("OpenLSM: %w", err)
+				}
+				s.addTable(level, t)
+			}
+		}
+	}
+
+	walPath := filepath.Join(dir, lsmWalName)
+	if err := s.replayWal(walPath); err != nil {
+		return nil, err
+	}
+	s.wal, err = os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	go s.runCompactor()
+	s.compactCh <- struct{}{}
+	return s, nil
+}
+
+func (s *LSMStore) replayWal(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	for {
+		var rec entry
+		_, err := rec.DecodeFromReader(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("OpenLSM, wal decode error: %w", err)
+		}
+		s.applyToMemtable(rec)
+	}
+}
+
+func (s *LSMStore) openTable(path string, rebuild bool) (*table, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{segment: &segment{path: path, size: info.Size()}}
+	if t.version, err = fileFormatVersion(path); err != nil {
+		return nil, err
+	}
+	if rebuild {
+		t.filter, err = buildSegmentFilter(path, s.opts.bloomFalsePositiveRate())
+	} else {
+		t.filter, err = loadSegmentFilter(path, s.opts.bloomFalsePositiveRate())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rebuild {
+		t.sparse, err = buildSegmentIndex(path)
+	} else {
+		t.sparse, err = loadSegmentIndex(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *LSMStore) addTable(level int, t *table) {
+	for len(s.levels) <= level {
+		s.levels = append(s.levels, nil)
+	}
+	s.levels[level] = append(s.levels[level], t)
+}
+
+func (s *LSMStore) applyToMemtable(rec entry) {
+	if old, ok := s.memtable[rec.key]; ok {
+		s.memSize -= int64(len(rec.key) + len(old))
+	}
+	s.memtable[rec.key] = rec.value
+	s.memSize += int64(len(rec.key) + len(rec.value))
+}
+
+func (s *LSMStore) write(rec entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.writeLocked(rec)
+}
+
+// writeLocked logs records with a single write and applies them to the
+// memtable, flushing it once it is full. Callers hold mu.
+func (s *LSMStore) writeLocked(records ...entry) error {
+	var buf []byte
+	for _, rec := range records {
+		buf = append(buf, rec.Encode()...)
+	}
+	if _, err := s.wal.Write(buf); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		s.applyToMemtable(rec)
+	}
+	s.writes.Add(uint64(len(records)))
+	if s.memSize < LSMMemtableSize {
+		return nil
+	}
+	return s.flush()
+}
+
+func (s *LSMStore) Put(key, value string) error {
+	return s.write(entry{key: key, value: value})
+}
+
+// Delete writes a tombstone, an empty value, that shadows older tables
+// until compaction reaches the last level.
+func (s *LSMStore) Delete(key string) error {
+	return s.write(entry{key: key})
+}
+
+// Transact runs fn under the write lock, so its reads and the writes it
+// collects happen in one step. The engine does not keep expiry times, so
+// writes with a TTL fail the transaction.
+func (s *LSMStore) Transact(fn func(tx *Txn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	tx := &Txn{get: func(key string) (entry, error) {
+		s.reads.Add(1)
+		return s.lookup(key)
+	}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	for _, rec := range tx.records {
+		if rec.expiresAt != 0 {
+			return errors.New("LSMStore: TTLs are not supported")
+		}
+	}
+	if len(tx.records) == 0 {
+		return nil
+	}
+	return s.writeLocked(tx.records...)
+}
+
+func (s *LSMStore) Get(key string) (string, error) {
+	s.reads.Add(1)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, err := s.lookup(key)
+	return rec.value, err
+}
+
+// lookup reads the latest live value of key, callers holding mu.
+func (s *LSMStore) lookup(key string) (entry, error) {
+	value, pos, ok, err := s.locate(key)
+	if err != nil {
+		return entry{}, err
+	}
+	if ok && pos.fileName != "" {
+		rec, err := readRecord(pos)
+		if err != nil {
+			return entry{}, err
+		}
+		value = rec.value
+	}
+	if value == "" {
+		return entry{}, ErrNotFound
+	}
+	return entry{key: key, value: value}, nil
+}
+
+func (s *LSMStore) Stat(key string) (ValueInfo, error) {
+	s.reads.Add(1)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stat(key)
+}
+
+func (s *LSMStore) stat(key string) (ValueInfo, error) {
+	value, pos, ok, err := s.locate(key)
+	if err != nil {
+		return ValueInfo{}, err
+	}
+	if ok && pos.fileName != "" {
+		return statRecord(pos, key)
+	}
+	if value == "" {
+		return ValueInfo{}, ErrNotFound
+	}
+	return ValueInfo{Size: len(value)}, nil
+}
+
+// Swap is Put, or Delete for an empty value, telling whether key had a
+// value. The engine does not keep content types.
+func (s *LSMStore) Swap(key, value, contentType string) (bool, error) {
+	if contentType != "" {
+		return false, errors.New("LSMStore: content types are not supported")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false, ErrClosed
+	}
+	_, err := s.stat(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	found := err == nil
+	if !found && value == "" {
+		return false, nil
+	}
+	return found, s.writeLocked(entry{key: key, value: value})
+}
+
+// locate finds the latest version of key, callers holding mu. A memtable
+// hit returns the value, which is empty for tombstones, and a table hit the
+// position of the record.
+func (s *LSMStore) locate(key string) (value string, pos filePos, ok bool, err error) {
+	if value, ok := s.memtable[key]; ok {
+		return value, filePos{}, true, nil
+	}
+
+	for _, t := range s.lookupOrder() {
+		if !t.filter.mayContain(key) {
+			s.bloomNegatives.Add(1)
+			continue
+		}
+		offset, found, err := t.sparse.find(key)
+		if err != nil {
+			return "", filePos{}, false, err
+		}
+		if found {
+			return "", filePos{fileName: t.path, offset: offset}, true, nil
+		}
+	}
+	return "", filePos{}, false, nil
+}
+
+// lookupOrder lists tables from the newest data to the oldest.
+func (s *LSMStore) lookupOrder() []*table {
+	var res []*table
+	for level, tables := range s.levels {
+		if level == 0 {
+			for i := len(tables) - 1; i >= 0; i-- {
+				res = append(res, tables[i])
+			}
+			continue
+		}
+		res = append(res, tables...)
+	}
+	return res
+}
+
+func tableSegments(tables []*table) []*segment {
+	res := make([]*segment, len(tables))
+	for i, t := range tables {
+		res[i] = t.segment
+	}
+	return res
+}
+
+func (s *LSMStore) Scan(prefix string, fn func(key, value string) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var memKeys []string
+	for key := range s.memtable {
+		if strings.HasPrefix(key, prefix) {
+			memKeys = append(memKeys, key)
+		}
+	}
+	sort.Strings(memKeys)
+
+	// segmentIterators expects the oldest segment first.
+	order := s.lookupOrder()
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	its, err := segmentIterators(tableSegments(order), prefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, it := range its {
+			it.close()
+		}
+	}()
+
+	emitMem := func(key string) error {
+		if value := s.memtable[key]; value != "" {
+			return fn(key, value)
+		}
+		return nil
+	}
+	err = mergeIterators(its, prefix, func(key string, pos filePos) error {
+		for len(memKeys) > 0 && memKeys[0] < key {
+			if err := emitMem(memKeys[0]); err != nil {
+				return err
+			}
+			memKeys = memKeys[1:]
+		}
+		if len(memKeys) > 0 && memKeys[0] == key {
+			memKeys = memKeys[1:]
+			return emitMem(key)
+		}
+		rec, err := readRecord(pos)
+		if err != nil {
+			return err
+		}
+		if rec.value == "" {
+			return nil
+		}
+		return fn(key, rec.value)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range memKeys {
+		if err := emitMem(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LSMStore) newTablePath() string {
+	s.nextTable++
+	return filepath.Join(s.dir, fmt.Sprintf("sst_%d.dat", s.nextTable))
+}
+
+// flush writes the memtable as a new level 0 table, resets the log and
+// wakes the compactor. Callers hold mu.
+func (s *LSMStore) flush() error {
+	if len(s.memtable) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(s.memtable))
+	for key := range s.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	path := s.newTablePath()
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	if _, err := w.Write(segmentHeader()); err != nil {
+		out.Close()
+		return fmt.Errorf("flush: %w", err)
+	}
+	for _, key := range keys {
+		rec := entry{key: key, value: s.memtable[key]}
+		if _, err := w.Write(rec.Encode()); err != nil {
+			out.Close()
+			return fmt.Errorf("flush: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("flush: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	t, err := s.openTable(path, true)
+	if err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	s.addTable(0, t)
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	s.wal, err = os.OpenFile(filepath.Join(s.dir, lsmWalName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	s.memtable = make(map[string]string)
+	s.memSize = 0
+	select {
+	case s.compactCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *LSMStore) writeManifest() error {
+	m := lsmManifest{NextTable: s.nextTable, Levels: make([][]string, len(s.levels))}
+	for level, tables := range s.levels {
+		for _, t := range tables {
+			m.Levels[level] = append(m.Levels[level], filepath.Base(t.path))
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, lsmManifestName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, lsmManifestName))
+}
+
+func levelSize(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+func levelLimit(level int) int64 {
+	limit := LSMLevelBaseSize
+	for i := 1; i < level; i++ {
+		limit *= LSMLevelRatio
+	}
+	return limit
+}
+
+// compaction merges tables of one level into the tables of the next level
+// whose key ranges overlap them.
+type compaction struct {
+	level  int
+	inputs []*table
+	// overlap lists the tables of the target level replaced by the output.
+	overlap        []*table
+	dropTombstones bool
+}
+
+// pickCompaction chooses a table of the first level over its limit: level 0
+// by table count, deeper levels by total size. Level 0 gives its oldest
+// table, which every other level 0 table shadows; deeper levels take turns
+// over their tables in key order. Callers hold mu.
+func (s *LSMStore) pickCompaction() *compaction {
+	for level, tables := range s.levels {
+		var src *table
+		if level == 0 {
+			if len(tables) <= LSML0Tables {
+				continue
+			}
+			src = tables[0]
+		} else {
+			if levelSize(tables) <= levelLimit(level) {
+				continue
+			}
+			src = tables[0]
+			for _, t := range tables {
+				if first, _ := t.keyRange(); first > s.cursor(level) {
+					src = t
+					break
+				}
+			}
+		}
+
+		c := &compaction{level: level, inputs: []*table{src}, dropTombstones: true}
+		first, last := src.keyRange()
+		if level+1 < len(s.levels) {
+			for _, t := range s.levels[level+1] {
+				if t.overlaps(first, last) {
+					c.overlap = append(c.overlap, t)
+				}
+			}
+		}
+		// Tombstones can only be dropped when no older level may hold the
+		// key. Older versions in the target level are among the overlapping
+		// tables, which the merge replaces.
+		for _, tables := range s.levels[min(level+2, len(s.levels)):] {
+			if len(tables) > 0 {
+				c.dropTombstones = false
+			}
+		}
+		return c
+	}
+	return nil
+}
+
+func (s *LSMStore) cursor(level int) string {
+	if level < len(s.cursors) {
+		return s.cursors[level]
+	}
+	return ""
+}
+
+func (s *LSMStore) runCompactor() {
+	defer close(s.compactorDone)
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-s.compactCh:
+		}
+		if err := s.compact(); err != nil {
+			s.mu.Lock()
+			s.compactErr = err
+			s.mu.Unlock()
+		}
+	}
+}
+
+// compact runs compactions until every level is within its limit or the
+// store is closing. Tables are immutable, so the merge runs without mu,
+// which is only taken to pick the tables and to install the result.
+func (s *LSMStore) compact() error {
+	for {
+		select {
+		case <-s.closing:
+			return nil
+		default:
+		}
+		s.mu.RLock()
+		c := s.pickCompaction()
+		s.mu.RUnlock()
+		if c == nil {
+			return nil
+		}
+		outputs, err := s.merge(c)
+		if err != nil {
+			return fmt.Errorf("compact level %d: %w", c.level, err)
+		}
+		if err := s.install(c, outputs); err != nil {
+			return fmt.Errorf("compact level %d: %w", c.level, err)
+		}
+	}
+}
+
+// merge writes the records of the compaction inputs as tables of at most
+// LSMTableSize bytes.
+func (s *LSMStore) merge(c *compaction) ([]*table, error) {
+	// segmentIterators expects the oldest segment first: the target level
+	// tables, which are disjoint, then the inputs.
+	oldestFirst := append(append([]*table(nil), c.overlap...), c.inputs...)
+	its, err := segmentIterators(tableSegments(oldestFirst), "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, it := range its {
+			it.close()
+		}
+	}()
+
+	var (
+		outputs []*table
+		out     *os.File
+		w       *bufio.Writer
+		written int64
+	)
+	finish := func() error {
+		if out == nil {
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		t, err := s.openTable(out.Name(), true)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		out = nil
+		return nil
+	}
+
+	err = mergeIterators(its, "", func(key string, pos filePos) error {
+		rec, err := readRecord(pos)
+		if err != nil {
+			return err
+		}
+		if rec.value == "" && c.dropTombstones {
+			return nil
+		}
+		if out == nil {
+			s.mu.Lock()
+			path := s.newTablePath()
+			s.mu.Unlock()
+			if out, err = os.Create(path); err != nil {
+				return err
+			}
+			w = bufio.NewWriter(out)
+			written = 0
+			if _, err := w.Write(segmentHeader()); err != nil {
+				return err
+			}
+		}
+		n, err := w.Write(rec.Encode())
+		if err != nil {
+			return err
+		}
+		written += int64(n)
+		if written >= LSMTableSize {
+			return finish()
+		}
+		return nil
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		removeTables(outputs)
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// install replaces the inputs and the overlapping tables of a compaction by
+// its outputs, keeping the target level sorted by key.
+func (s *LSMStore) install(c *compaction, outputs []*table) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := c.level + 1
+	for len(s.levels) <= target {
+		s.levels = append(s.levels, nil)
+	}
+	for len(s.cursors) <= c.level {
+		s.cursors = append(s.cursors, "")
+	}
+
+	s.levels[c.level] = withoutTables(s.levels[c.level], c.inputs)
+	tables := append(withoutTables(s.levels[target], c.overlap), outputs...)
+	sort.Slice(tables, func(i, j int) bool {
+		a, _ := tables[i].keyRange()
+		b, _ := tables[j].keyRange()
+		return a < b
+	})
+	s.levels[target] = tables
+	_, s.cursors[c.level] = c.inputs[len(c.inputs)-1].keyRange()
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+	// Readers look tables up under mu, so none of them still uses the
+	// replaced ones.
+	removeTables(c.inputs)
+	removeTables(c.overlap)
+	return nil
+}
+
+func withoutTables(tables, remove []*table) []*table {
+	var res []*table
+	for _, t := range tables {
+		if !slices.Contains(remove, t) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func removeTables(tables []*table) {
+	for _, t := range tables {
+		_ = os.Remove(t.path)
+		_ = os.Remove(bloomPath(t.path))
+		_ = os.Remove(indexPath(t.path))
+	}
+}
+
+func (s *LSMStore) Stats() Stats {
+	st := Stats{
+		Engine:                 "lsm",
+		IndexMode:              SparseIndexMode.String(),
+		BloomFalsePositiveRate: s.opts.bloomFalsePositiveRate(),
+		BloomNegatives:         s.bloomNegatives.Load(),
+		Reads:                  s.reads.Load(),
+		Writes:                 s.writes.Load(),
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for level, tables := range s.levels {
+		for _, t := range tables {
+			ss := t.stats()
+			ss.Level = level
+			st.Segments = append(st.Segments, ss)
+		}
+	}
+	st.SegmentCount = len(st.Segments)
+	return st
+}
+
+// Close stops the compactor and flushes the memtable so that the next open
+// does not need to replay the write-ahead log. It reports the last failed
+// compaction, whose inputs stay in place.
+func (s *LSMStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.closing)
+	<-s.compactorDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		s.wal.Close()
+		return err
+	}
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	return s.compactErr
+}
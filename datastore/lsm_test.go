@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitCompacted waits until no level of s is over its limit. The compactor
+// only works on a table picked while one is, so it is idle then.
+func waitCompacted(t *testing.T, s *LSMStore) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.RLock()
+		c := s.pickCompaction()
+		s.mu.RUnlock()
+		if c == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compaction of level %d did not finish", c.level)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func levelPaths(s *LSMStore, level int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []string
+	if level < len(s.levels) {
+		for _, t := range s.levels[level] {
+			res = append(res, t.path)
+		}
+	}
+	return res
+}
+
+func TestLSMStore_Compaction(t *testing.T) {
+	oldMemtable, oldTable, oldBase := LSMMemtableSize, LSMTableSize, LSMLevelBaseSize
+	LSMMemtableSize, LSMTableSize, LSMLevelBaseSize = 1024, 2048, 8*1024
+	// Registered before the store is closed, so that the compactor is gone.
+	t.Cleanup(func() { LSMMemtableSize, LSMTableSize, LSMLevelBaseSize = oldMemtable, oldTable, oldBase })
+
+	dir := t.TempDir()
+	s, err := OpenLSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	for i := 0; i < 2000; i++ {
+		if err := s.Put(fmt.Sprintf("key-%04d", i%700), strings.Repeat("v", 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCompacted(t, s)
+
+	levels := make(map[int]int)
+	for _, seg := range s.Stats().Segments {
+		levels[seg.Level]++
+	}
+	if levels[0] > LSML0Tables {
+		t.Errorf("level 0 holds %d tables, limit is %d", levels[0], LSML0Tables)
+	}
+	if levels[2] == 0 {
+		t.Errorf("expected compaction into deeper levels, got %v", levels)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.dat"))
+	if len(files) != len(s.Stats().Segments) {
+		t.Errorf("compacted tables were not removed: %d files for %d tables", len(files), len(s.Stats().Segments))
+	}
+	if _, err := os.Stat(filepath.Join(dir, lsmManifestName)); err != nil {
+		t.Errorf("manifest is missing: %v", err)
+	}
+}
+
+func TestLSMStore_LeveledCompaction(t *testing.T) {
+	oldMemtable, oldTable, oldL0, oldBase := LSMMemtableSize, LSMTableSize, LSML0Tables, LSMLevelBaseSize
+	LSMMemtableSize, LSMTableSize, LSML0Tables, LSMLevelBaseSize = 1<<20, 1024, 0, 1<<20
+	t.Cleanup(func() {
+		LSMMemtableSize, LSMTableSize, LSML0Tables, LSMLevelBaseSize = oldMemtable, oldTable, oldL0, oldBase
+	})
+
+	s, err := OpenLSM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	flush := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		if err := s.Put(fmt.Sprintf("k%03d", i), strings.Repeat("v", 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush()
+	waitCompacted(t, s)
+	before := levelPaths(s, 1)
+	if len(before) < 5 {
+		t.Fatalf("level 1 holds %d tables", len(before))
+	}
+
+	if err := s.Put("k150", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("k151"); err != nil {
+		t.Fatal(err)
+	}
+	flush()
+	waitCompacted(t, s)
+
+	if l0 := levelPaths(s, 0); len(l0) != 0 {
+		t.Errorf("level 0 still holds %v", l0)
+	}
+	after := levelPaths(s, 1)
+	kept := 0
+	for _, path := range before {
+		if slices.Contains(after, path) {
+			kept++
+		}
+	}
+	// Only the tables holding k150 and k151 are rewritten.
+	if kept == len(before) || kept < len(before)-2 {
+		t.Errorf("compaction kept %d of %d level 1 tables", kept, len(before))
+	}
+	if v, err := s.Get("k150"); err != nil || v != "new" {
+		t.Errorf("Get(k150) = (%q, %v)", v, err)
+	}
+	if _, err := s.Get("k151"); err != ErrNotFound {
+		t.Errorf("Get(k151) returned %v", err)
+	}
+	if v, err := s.Get("k152"); err != nil || v != strings.Repeat("v", 40) {
+		t.Errorf("Get(k152) = (%q, %v)", v, err)
+	}
+	var keys []string
+	if err := s.Scan("", func(key, _ string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 299 || !slices.IsSorted(keys) {
+		t.Errorf("Scan visited %d keys, sorted: %t", len(keys), slices.IsSorted(keys))
+	}
+}
@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore keeps all records in memory with the same semantics as Db: empty
+// values act as deletes, expired values are reported as missing and batches
+// are applied atomically. It is meant for tests of code built on top of the
+// datastore.
+type MemStore struct {
+	mu   sync.RWMutex
+	data map[string]entry
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{data: make(map[string]entry)}
+}
+
+func (s *MemStore) apply(records ...entry) {
+	for _, rec := range records {
+		if rec.value == "" {
+			delete(s.data, rec.key)
+		} else {
+			s.data[rec.key] = rec
+		}
+	}
+}
+
+func (s *MemStore) Put(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(entry{key: key, value: value})
+	return nil
+}
+
+func (s *MemStore) PutTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(entry{key: key, value: value, expiresAt: time.Now().Add(ttl).UnixNano()})
+	return nil
+}
+
+func (s *MemStore) PutTyped(key, value, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(entry{key: key, value: value, contentType: contentType})
+	return nil
+}
+
+func (s *MemStore) Swap(key, value, contentType string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, found := s.data[key]
+	found = found && !rec.expired(time.Now())
+	if found || value != "" {
+		s.apply(entry{key: key, value: value, contentType: contentType})
+	}
+	return found, nil
+}
+
+func (s *MemStore) Stat(key string) (ValueInfo, error) {
+	s.mu.RLock()
+	rec, ok := s.data[key]
+	s.mu.RUnlock()
+	if !ok || rec.expired(time.Now()) {
+		return ValueInfo{}, ErrNotFound
+	}
+	return rec.info(len(rec.value)), nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(entry{key: key})
+	return nil
+}
+
+func (s *MemStore) Write(b *Batch) error {
+	if b.err != nil {
+		return b.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(b.records...)
+	return nil
+}
+
+func (s *MemStore) Transact(fn func(tx *Txn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &Txn{get: func(key string) (entry, error) {
+		rec, ok := s.data[key]
+		if !ok || rec.expired(time.Now()) {
+			return entry{}, ErrNotFound
+		}
+		return rec, nil
+	}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	s.apply(tx.records...)
+	return nil
+}
+
+func (s *MemStore) Get(key string) (string, error) {
+	value, _, err := s.GetTyped(key)
+	return value, err
+}
+
+func (s *MemStore) GetTyped(key string) (string, string, error) {
+	s.mu.RLock()
+	rec, ok := s.data[key]
+	s.mu.RUnlock()
+	if !ok || rec.expired(time.Now()) {
+		return "", "", ErrNotFound
+	}
+	return rec.value, rec.contentType, nil
+}
+
+func (s *MemStore) Scan(prefix string, fn func(key, value string) error) error {
+	now := time.Now()
+	s.mu.RLock()
+	var records []entry
+	for key, rec := range s.data {
+		if strings.HasPrefix(key, prefix) && !rec.expired(now) {
+			records = append(records, rec)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+
+	for _, rec := range records {
+		if err := fn(rec.key, rec.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Stats{Engine: "memory", Keys: len(s.data)}
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
@@ -7,119 +7,355 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"time"
 )
 
+// MergeSegments rewrites the closed segments into one holding only their
+// live records. Closed segments never change, so the merged segment is
+// written while writes go on, and only swapped in by the writer goroutine:
+// readers see either the old or the merged segments, and segments rotated
+// meanwhile stay after it.
 func (db *Db) MergeSegments() error {
-	entries, err := os.ReadDir(db.dir)
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	start := time.Now()
+	// In sparse mode the merged segment keeps records that keys of the
+	// active file shadow, and later writes shadow more of them. Their keys
+	// are collected from when the segments are taken, so the writer can
+	// count the merged segment's live records on install.
+	var segments []*segment
+	if err := db.run(func() error {
+		segments = db.segments
+		if db.opts.IndexMode == SparseIndexMode && len(segments) > 0 {
+			db.shadowed = make(map[string]struct{}, len(db.index))
+			for key := range db.index {
+				db.shadowed[key] = struct{}{}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	paths := make([]string, len(segments))
+	for i, seg := range segments {
+		paths[i] = seg.path
+	}
+
+	// The merged segment, its filter and its index are written under
+	// temporary names and only replace the old segments once complete.
+	mergedPath := filepath.Join(db.dir, mergedFileName)
+	seg, index, err := db.writeMerged(segments, paths, mergedPath)
+	if err == nil {
+		err = db.run(func() error { return db.installMerged(segments, seg, index) })
+		if errors.Is(err, ErrClosed) {
+			removeSegmentFiles(mergedPath)
+		}
+	} else {
+		removeSegmentFiles(mergedPath)
+	}
 	if err != nil {
+		_ = db.run(func() error {
+			db.shadowed = nil
+			return nil
+		})
 		return err
 	}
 
-	var segments []string
-	for _, e := range entries {
-		if e.IsDir() {
+	elapsed := time.Since(start)
+	db.merges.Add(1)
+	db.mergeTime.Add(int64(elapsed))
+	db.lastMergeTime.Store(int64(elapsed))
+	return nil
+}
+
+// writeMerged writes the live records of segments to mergedPath and opens
+// the result. In hash mode it also indexes it under its final name.
+func (db *Db) writeMerged(segments []*segment, paths []string, mergedPath string) (*segment, hashIndex, error) {
+	mf, err := os.Create(mergedPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("MergeSegments: cannot create %s: %w", mergedFileName, err)
+	}
+	// Segments of older format versions are rewritten in the current one.
+	if _, err := mf.Write(segmentHeader()); err != nil {
+		mf.Close()
+		return nil, nil, fmt.Errorf("MergeSegments: write to %s: %w", mergedFileName, err)
+	}
+	if db.opts.IndexMode == SparseIndexMode {
+		err = db.writeMergedSparse(segments, mf)
+	} else {
+		err = writeMergedHash(paths, mf, db.liveBucketIDs())
+	}
+	if err == nil {
+		err = mf.Sync()
+	}
+	if err != nil {
+		mf.Close()
+		return nil, nil, err
+	}
+	if err := mf.Close(); err != nil {
+		return nil, nil, fmt.Errorf("MergeSegments: cannot close %s: %w", mergedFileName, err)
+	}
+	seg, err := db.openSegment(mergedPath, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("MergeSegments: %w", err)
+	}
+
+	var index hashIndex
+	if db.opts.IndexMode == HashIndexMode {
+		index = make(hashIndex)
+		if err := indexFile(index, mergedPath, filepath.Join(db.dir, "seg_0.dat")); err != nil {
+			return nil, nil, fmt.Errorf("MergeSegments: index merged segment: %w", err)
+		}
+	}
+	return seg, index, nil
+}
+
+// installMerged replaces the merged segments, the first ones of the list, by
+// seg. It runs in the writer goroutine. In hash mode, keys still indexed in
+// a merged segment move to their position in seg, or are dropped with the
+// expired and dead bucket records that seg leaves out.
+func (db *Db) installMerged(merged []*segment, seg *segment, index hashIndex) error {
+	mergedPath := seg.path
+	finalPath := filepath.Join(db.dir, "seg_0.dat")
+	var usage fileUsage
+	if db.shadowed != nil {
+		var err error
+		if usage, err = mergedUsage(seg, db.shadowed); err != nil {
+			return fmt.Errorf("MergeSegments: %w", err)
+		}
+		db.shadowed = nil
+	}
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+	// A crash at any point leaves either the old segments or the merged one
+	// with old ones that it supersedes; missing filters and indexes are
+	// rebuilt on open.
+	_ = os.Remove(bloomPath(finalPath))
+	_ = os.Remove(indexPath(finalPath))
+	if err := os.Rename(mergedPath, finalPath); err != nil {
+		return fmt.Errorf("MergeSegments: rename %s: %w", mergedFileName, err)
+	}
+	seg.path = finalPath
+	if seg.sparse != nil {
+		if err := os.Rename(bloomPath(mergedPath), bloomPath(finalPath)); err != nil {
+			return fmt.Errorf("MergeSegments: rename filter: %w", err)
+		}
+		if err := os.Rename(indexPath(mergedPath), indexPath(finalPath)); err != nil {
+			return fmt.Errorf("MergeSegments: rename index: %w", err)
+		}
+		seg.sparse.path = indexPath(finalPath)
+	}
+	inputs := make(map[string]bool, len(merged))
+	for _, old := range merged {
+		inputs[old.path] = true
+		if old.path != finalPath {
+			removeSegmentFiles(old.path)
+		}
+	}
+
+	db.mu.Lock()
+	newer := db.segments[len(merged):]
+	db.segments = append([]*segment{seg}, newer...)
+	if index != nil {
+		for key, pos := range db.index {
+			if !inputs[pos.fileName] {
+				continue
+			}
+			if pos, ok := index[key]; ok {
+				db.index[key] = pos
+				usage.keys++
+				usage.bytes += pos.size
+			} else {
+				delete(db.index, key)
+			}
+		}
+	}
+	for path := range inputs {
+		delete(db.usage, path)
+	}
+	db.usage[finalPath] = usage
+	db.mu.Unlock()
+	// Segments rotated during the merge keep their names after seg_0.
+	if len(newer) == 0 {
+		db.segmentIndex = 1
+	}
+	db.generation++
+	return nil
+}
+
+// mergedUsage counts the live records of a merged sparse segment: all of
+// its records but those of the shadowed keys.
+func mergedUsage(seg *segment, shadowed map[string]struct{}) (fileUsage, error) {
+	usage := fileUsage{keys: seg.sparse.count, bytes: seg.size - segmentHeaderSize}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return fileUsage{}, err
+	}
+	defer f.Close()
+	for key := range shadowed {
+		if !seg.filter.mayContain(key) {
 			continue
 		}
-		name := e.Name()
-		if strings.HasPrefix(name, "seg_") && strings.HasSuffix(name, ".dat") {
-			segments = append(segments, filepath.Join(db.dir, name))
+		offset, found, err := seg.sparse.find(key)
+		if err != nil {
+			return fileUsage{}, err
 		}
+		if !found {
+			continue
+		}
+		size, _, err := readRecordSize(f, offset, key)
+		if err != nil {
+			return fileUsage{}, err
+		}
+		usage.keys--
+		usage.bytes -= size
 	}
-	if len(segments) == 0 {
+	return usage, nil
+}
+
+func removeSegmentFiles(path string) {
+	_ = os.Remove(path)
+	_ = os.Remove(bloomPath(path))
+	_ = os.Remove(indexPath(path))
+}
+
+// indexFile adds the positions of the records in the file at path to idx
+// under the file name name.
+func indexFile(idx hashIndex, path, name string) error {
+	r, err := openSegmentReader(path)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.close()
+	for {
+		rec, offset, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.value == "" {
+			delete(idx, rec.key)
+		} else {
+			idx[rec.key] = filePos{fileName: name, offset: offset, size: r.offset - offset}
+		}
 	}
+}
 
+func writeMergedHash(segments []string, mf *os.File, liveBuckets map[string]struct{}) error {
 	type entryLoc struct {
 		filePath string
 		offset   int64
+		seq      uint64
 	}
 	latest := make(map[string]entryLoc)
 
 	for _, segPath := range segments {
-		f, err := os.Open(segPath)
+		r, err := openSegmentReader(segPath)
 		if err != nil {
 			return fmt.Errorf("MergeSegments: cannot open %s: %w", segPath, err)
 		}
-		in := bufio.NewReader(f)
-		var off int64 = 0
 		for {
-			var rec entry
-			n, errRead := rec.DecodeFromReader(in)
+			rec, off, errRead := r.next()
 			if errors.Is(errRead, io.EOF) {
 				break
 			}
 			if errRead != nil {
-				f.Close()
+				r.close()
 				return fmt.Errorf("MergeSegments: decode error in %s: %w", segPath, errRead)
 			}
-			latest[rec.key] = entryLoc{filePath: segPath, offset: off}
-			off += int64(n)
+			latest[rec.key] = entryLoc{filePath: segPath, offset: off, seq: rec.seq}
 		}
-		f.Close()
+		r.close()
 	}
 
-	mergedPath := filepath.Join(db.dir, "merged.tmp")
-	mf, err := os.Create(mergedPath)
-	if err != nil {
-		return fmt.Errorf("MergeSegments: cannot create merged.tmp: %w", err)
+	// Records keep their relative order, records without sequence numbers
+	// being the oldest.
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := latest[keys[i]], latest[keys[j]]
+		if a.seq != b.seq {
+			return a.seq < b.seq
+		}
+		return keys[i] < keys[j]
+	})
 
-	for key, loc := range latest {
+	now := time.Now()
+	for _, key := range keys {
+		loc := latest[key]
 		sf, err := os.Open(loc.filePath)
 		if err != nil {
-			mf.Close()
 			return fmt.Errorf("MergeSegments: cannot reopen %s: %w", loc.filePath, err)
 		}
+		version, err := readFileVersion(sf)
+		if err != nil {
+			sf.Close()
+			return fmt.Errorf("MergeSegments: %s: %w", loc.filePath, err)
+		}
 		if _, err := sf.Seek(loc.offset, io.SeekStart); err != nil {
 			sf.Close()
-			mf.Close()
 			return fmt.Errorf("MergeSegments: cannot seek %s: %w", loc.filePath, err)
 		}
 		var rec entry
-		if _, err := rec.DecodeFromReader(bufio.NewReader(sf)); err != nil {
+		if _, err := rec.decodeFromReader(bufio.NewReader(sf), version); err != nil {
 			sf.Close()
-			mf.Close()
 			return fmt.Errorf("MergeSegments: decodeFromReader: %w", err)
 		}
 		sf.Close()
 
-		if rec.value == "" {
-			delete(latest, key)
+		if rec.value == "" || rec.expired(now) || deadBucketKey(key, liveBuckets) {
 			continue
 		}
 
 		if _, err := mf.Write(rec.Encode()); err != nil {
-			mf.Close()
-			return fmt.Errorf("MergeSegments: write to merged.tmp: %w", err)
+			return fmt.Errorf("MergeSegments: write merged segment: %w", err)
 		}
 	}
 
-	if err := mf.Close(); err != nil {
-		return fmt.Errorf("MergeSegments: cannot close merged.tmp: %w", err)
-	}
-
-	for _, segPath := range segments {
-		_ = os.Remove(segPath)
-	}
+	return nil
+}
 
-	finalPath := filepath.Join(db.dir, "seg_0.dat")
-	if err := os.Rename(mergedPath, finalPath); err != nil {
-		return fmt.Errorf("MergeSegments: rename merged.tmp: %w", err)
+// writeMergedSparse merges the sorted segment indexes, so the merged segment
+// is written in key order without holding all keys in memory.
+func (db *Db) writeMergedSparse(segments []*segment, mf *os.File) error {
+	its, err := segmentIterators(segments, "")
+	if err != nil {
+		return fmt.Errorf("MergeSegments: %w", err)
 	}
+	defer func() {
+		for _, it := range its {
+			it.close()
+		}
+	}()
 
-	db.mu.Lock()
-	db.index = make(hashIndex)
-	db.mu.Unlock()
-
-	if err := db.recoverFile(finalPath); err != nil {
-		return fmt.Errorf("MergeSegments: recover merged segment: %w", err)
-	}
-	currPath := filepath.Join(db.dir, outFileName)
-	if err := db.recoverFile(currPath); err != nil {
-		return fmt.Errorf("MergeSegments: recover current-data: %w", err)
+	w := bufio.NewWriter(mf)
+	now := time.Now()
+	live := db.liveBucketIDs()
+	err = mergeIterators(its, "", func(key string, pos filePos) error {
+		rec, err := readRecord(pos)
+		if err != nil {
+			return fmt.Errorf("MergeSegments: %w", err)
+		}
+		if rec.value == "" || rec.expired(now) || deadBucketKey(key, live) {
+			return nil
+		}
+		if _, err := w.Write(rec.Encode()); err != nil {
+			return fmt.Errorf("MergeSegments: write merged segment: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	db.segmentIndex = 1
-	return nil
+	return w.Flush()
 }
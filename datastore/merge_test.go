@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDb_MergeConcurrentWrites(t *testing.T) {
+	saved := MaxSegmentSize
+	MaxSegmentSize = 300
+	t.Cleanup(func() { MaxSegmentSize = saved })
+
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := OpenWithOptions(dir, Options{IndexMode: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const writers, perWriter = 4, 100
+			var first atomic.Bool
+			stop := make(chan struct{})
+			var wg, readers sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// Keys are overwritten while merges copy their old
+					// values, which must not come back.
+					for i := 0; i < perWriter; i++ {
+						key := fmt.Sprintf("w%d-%03d", w, i)
+						if err := db.Put(key, "old"); err != nil {
+							t.Error(err)
+							return
+						}
+						if err := db.Put(key, "value"); err != nil {
+							t.Error(err)
+							return
+						}
+						if w == 0 && i == 0 {
+							first.Store(true)
+						}
+					}
+				}()
+			}
+			// Keys written before a merge stay readable while it runs.
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if !first.Load() {
+						continue
+					}
+					if v, err := db.Get("w0-000"); err != nil || v != "value" {
+						t.Errorf("Get during merge = (%q, %v)", v, err)
+						return
+					}
+				}
+			}()
+			for i := 0; i < 20; i++ {
+				if err := db.MergeSegments(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wg.Wait()
+			if err := db.MergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			close(stop)
+			readers.Wait()
+
+			check := func(db *Db) {
+				t.Helper()
+				n := 0
+				if err := db.Scan("", func(string, string) error {
+					n++
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if n != writers*perWriter {
+					t.Errorf("scanned %d keys, expected %d", n, writers*perWriter)
+				}
+				for w := 0; w < writers; w++ {
+					for i := 0; i < perWriter; i++ {
+						key := fmt.Sprintf("w%d-%03d", w, i)
+						if v, err := db.Get(key); err != nil || v != "value" {
+							t.Fatalf("Get(%s) = (%q, %v)", key, v, err)
+						}
+					}
+				}
+			}
+			check(db)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = OpenWithOptions(dir, Options{IndexMode: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			check(db)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDb_Ping(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(context.Background()); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	// A writer busy with a long request does not answer until it is done.
+	started, release, finished := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		finished <- db.run(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := db.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ping of a busy writer: %v", err)
+	}
+	close(release)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedDb_Ping(t *testing.T) {
+	db, err := OpenSharded(t.TempDir(), 3, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Ping(context.Background()); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrIndexNotFound = fmt.Errorf("index does not exist")
+	ErrIndexExists   = fmt.Errorf("index already exists")
+	ErrInvalidIndex  = fmt.Errorf("invalid index definition")
+)
+
+// Index definitions are kept in the log like bucket metadata:
+//
+//	\x00i\x00{name} -> JSON path, e.g. "user.id"
+const indexMetaPrefix = "\x00i\x00"
+
+// secondaryIndex maps a scalar field of JSON values to the plain keys
+// holding it. Only keys outside buckets are indexed.
+type secondaryIndex struct {
+	path    string
+	fields  []string
+	entries map[string]map[string]struct{}
+	byKey   map[string]string
+}
+
+func newSecondaryIndex(path string) *secondaryIndex {
+	return &secondaryIndex{
+		path:    path,
+		fields:  strings.Split(path, "."),
+		entries: make(map[string]map[string]struct{}),
+		byKey:   make(map[string]string),
+	}
+}
+
+func (idx *secondaryIndex) remove(key string) {
+	old, ok := idx.byKey[key]
+	if !ok {
+		return
+	}
+	delete(idx.byKey, key)
+	delete(idx.entries[old], key)
+	if len(idx.entries[old]) == 0 {
+		delete(idx.entries, old)
+	}
+}
+
+func (idx *secondaryIndex) update(key string, doc any) {
+	idx.remove(key)
+	value, ok := jsonField(doc, idx.fields)
+	if !ok {
+		return
+	}
+	if idx.entries[value] == nil {
+		idx.entries[value] = make(map[string]struct{})
+	}
+	idx.entries[value][key] = struct{}{}
+	idx.byKey[key] = value
+}
+
+func parseJSON(value string) any {
+	var doc any
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	return doc
+}
+
+// jsonField returns the scalar at path formatted as a string. Objects,
+// arrays and nulls are not indexed.
+func jsonField(doc any, path []string) (string, bool) {
+	for _, field := range path {
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if doc, ok = obj[field]; !ok {
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// updateSecondary applies a committed record to the secondary indexes.
+// Callers hold db.mu.
+func (db *Db) updateSecondary(rec entry) {
+	if len(db.secondary) == 0 || IsInternalKey(rec.key) {
+		return
+	}
+	var doc any
+	if rec.value != "" {
+		doc = parseJSON(rec.value)
+	}
+	for _, idx := range db.secondary {
+		if rec.value == "" {
+			idx.remove(rec.key)
+		} else {
+			idx.update(rec.key, doc)
+		}
+	}
+}
+
+// buildSecondary fills new indexes from the current contents of the store.
+func (db *Db) buildSecondary(indexes map[string]*secondaryIndex) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	err := db.Scan("", func(key, value string) error {
+		if IsInternalKey(key) {
+			return nil
+		}
+		doc := parseJSON(value)
+		for _, idx := range indexes {
+			idx.update(key, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("build secondary index: %w", err)
+	}
+
+	db.mu.Lock()
+	for name, idx := range indexes {
+		db.secondary[name] = idx
+	}
+	db.mu.Unlock()
+	return nil
+}
+
+// loadSecondary rebuilds all declared indexes after recovery.
+func (db *Db) loadSecondary() error {
+	indexes := make(map[string]*secondaryIndex)
+	err := db.Scan(indexMetaPrefix, func(key, path string) error {
+		indexes[strings.TrimPrefix(key, indexMetaPrefix)] = newSecondaryIndex(path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.buildSecondary(indexes)
+}
+
+// applyIndexDefinition is called by the writer after an index definition
+// record is committed. Building the index in the writer guarantees that no
+// write slips between the backfill and regular maintenance.
+func (db *Db) applyIndexDefinition(rec entry) error {
+	if !strings.HasPrefix(rec.key, indexMetaPrefix) {
+		return nil
+	}
+	name := strings.TrimPrefix(rec.key, indexMetaPrefix)
+	if rec.value == "" {
+		db.mu.Lock()
+		delete(db.secondary, name)
+		db.mu.Unlock()
+		return nil
+	}
+	return db.buildSecondary(map[string]*secondaryIndex{name: newSecondaryIndex(rec.value)})
+}
+
+// CreateIndex declares an index on a dot-separated path of JSON values,
+// e.g. "userId" or "user.id", and builds it from existing data.
+func (db *Db) CreateIndex(name, path string) error {
+	if !validBucketName(name) || path == "" || strings.Contains(path, "..") {
+		return ErrInvalidIndex
+	}
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+
+	db.mu.RLock()
+	_, exists := db.secondary[name]
+	db.mu.RUnlock()
+	if exists {
+		return ErrIndexExists
+	}
+	return db.write(entry{key: indexMetaPrefix + name, value: path})
+}
+
+func (db *Db) DropIndex(name string) error {
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+
+	db.mu.RLock()
+	_, exists := db.secondary[name]
+	db.mu.RUnlock()
+	if !exists {
+		return ErrIndexNotFound
+	}
+	return db.write(entry{key: indexMetaPrefix + name})
+}
+
+// Indexes returns the JSON path of every declared index by name.
+func (db *Db) Indexes() map[string]string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	res := make(map[string]string, len(db.secondary))
+	for name, idx := range db.secondary {
+		res[name] = idx.path
+	}
+	return res
+}
+
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// FindBy returns the records, in ascending key order, whose JSON value holds
+// value at the path of the index.
+func (db *Db) FindBy(index, value string) ([]KeyValue, error) {
+	db.mu.RLock()
+	idx, ok := db.secondary[index]
+	var keys []string
+	if ok {
+		for key := range idx.entries[value] {
+			keys = append(keys, key)
+		}
+	}
+	db.mu.RUnlock()
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	sort.Strings(keys)
+
+	res := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		v, err := db.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			// Expired or deleted after the index was read.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, KeyValue{Key: key, Value: v})
+	}
+	return res, nil
+}
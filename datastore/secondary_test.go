@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func findKeys(t *testing.T, db *Db, index, value string) []string {
+	t.Helper()
+	res, err := db.FindBy(index, value)
+	if err != nil {
+		t.Fatalf("FindBy(%s, %s) failed: %v", index, value, err)
+	}
+	keys := []string{}
+	for _, kv := range res {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testSecondaryIndex(t, Options{IndexMode: mode})
+		})
+	}
+}
+
+func testSecondaryIndex(t *testing.T, opts Options) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("order1", `{"userId": "u1", "meta": {"total": 10}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("order2", `{"userId": "u2", "meta": {"total": 10}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", "not json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateIndex("byUser", "userId"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("byTotal", "meta.total"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("byUser", "other"); err != ErrIndexExists {
+		t.Errorf("expected ErrIndexExists, got %v", err)
+	}
+
+	if got := findKeys(t, db, "byUser", "u1"); !reflect.DeepEqual(got, []string{"order1"}) {
+		t.Errorf("backfilled index returned %v", got)
+	}
+	if got := findKeys(t, db, "byTotal", "10"); !reflect.DeepEqual(got, []string{"order1", "order2"}) {
+		t.Errorf("nested path index returned %v", got)
+	}
+
+	if err := db.Put("order3", `{"userId": "u1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("order1", `{"userId": "u2"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("order2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findKeys(t, db, "byUser", "u1"); !reflect.DeepEqual(got, []string{"order3"}) {
+		t.Errorf("maintained index returned %v for u1", got)
+	}
+	if got := findKeys(t, db, "byUser", "u2"); !reflect.DeepEqual(got, []string{"order1"}) {
+		t.Errorf("maintained index returned %v for u2", got)
+	}
+
+	if err := db.DropIndex("byTotal"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FindBy("byTotal", "10"); err != ErrIndexNotFound {
+		t.Errorf("expected ErrIndexNotFound, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if got := db.Indexes(); !reflect.DeepEqual(got, map[string]string{"byUser": "userId"}) {
+		t.Errorf("Indexes() after reopen = %v", got)
+	}
+	if got := findKeys(t, db, "byUser", "u1"); !reflect.DeepEqual(got, []string{"order3"}) {
+		t.Errorf("rebuilt index returned %v", got)
+	}
+}
@@ -3,8 +3,10 @@ package datastore
 import (
   "fmt"
   "os"
+  "path/filepath"
   "strings"
   "testing"
+  "time"
 )
 
 func TestSegmentCreationAndMerge(t *testing.T) {
@@ -87,3 +89,41 @@ func TestSegmentCreationAndMerge(t *testing.T) {
     t.Errorf("Expected non-empty value for key_10 after merge")
   }
 }
+
+func TestMergeDropsExpiredRecords(t *testing.T) {
+  dir := t.TempDir()
+
+  oldMax := MaxSegmentSize
+  MaxSegmentSize = 256
+  defer func() { MaxSegmentSize = oldMax }()
+
+  db, err := Open(dir)
+  if err != nil {
+    t.Fatalf("Open failed: %v", err)
+  }
+  defer db.Close()
+
+  if err := db.PutTTL("temp", strings.Repeat("t", 100), 20*time.Millisecond); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 10; i++ {
+    if err := db.Put("key_"+fmt.Sprint(i), strings.Repeat("x", 50)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  time.Sleep(40 * time.Millisecond)
+
+  if err := db.MergeSegments(); err != nil {
+    t.Fatalf("MergeSegments failed: %v", err)
+  }
+  data, err := os.ReadFile(filepath.Join(dir, "seg_0.dat"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if strings.Contains(string(data), "temp") {
+    t.Error("expired record survived the merge")
+  }
+  if _, err := db.Get("key_3"); err != nil {
+    t.Errorf("Expected key_3 to exist, got error %v", err)
+  }
+}
@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) {
+			saved := MaxSegmentSize
+			MaxSegmentSize = 128
+			t.Cleanup(func() { MaxSegmentSize = saved })
+
+			dir := t.TempDir()
+			opts := Options{IndexMode: mode}
+			db, err := OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 10; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", 9-i), "v"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var b Batch
+			b.Put("a", "1")
+			b.Delete("key0")
+			if err := db.Write(&b); err != nil {
+				t.Fatal(err)
+			}
+			if got := db.LastSeq(); got != 12 {
+				t.Errorf("LastSeq() = %d, expected 12", got)
+			}
+			if b.records[0].seq != 0 {
+				t.Errorf("the writer modified the batch")
+			}
+
+			if err := db.MergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("big", string(make([]byte, 200))); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("c", "3"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := db.Stats().LastSeq; got != 14 {
+				t.Errorf("restored LastSeq = %d, expected 14", got)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events, err := db.Watch(ctx, "", db.LastSeq())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("d", "4"); err != nil {
+				t.Fatal(err)
+			}
+			if ev := <-events; ev.Seq != 15 || ev.Key != "d" {
+				t.Errorf("unexpected event %+v", ev)
+			}
+			if _, err := db.Watch(ctx, "", 3); !errors.Is(err, ErrWatchPositionLost) {
+				t.Errorf("expected ErrWatchPositionLost for a position before the restart, got %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Without an active file the sequence comes from the newest segment.
+			if err := os.Remove(filepath.Join(dir, outFileName)); err != nil {
+				t.Fatal(err)
+			}
+			db, err = OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := db.LastSeq(); got != 13 {
+				t.Errorf("LastSeq() from segments = %d, expected 13", got)
+			}
+		})
+	}
+}
+
+func TestMergeKeepsWriteOrder(t *testing.T) {
+	saved := MaxSegmentSize
+	MaxSegmentSize = 128
+	t.Cleanup(func() { MaxSegmentSize = saved })
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%02d", (i*7)%20), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openSegmentReader(filepath.Join(dir, "seg_0.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	var last uint64
+	for {
+		rec, _, err := r.next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if rec.seq <= last {
+			t.Fatalf("record %s with seq %d follows seq %d", rec.key, rec.seq, last)
+		}
+		last = rec.seq
+	}
+	if last == 0 {
+		t.Fatal("merged segment is empty")
+	}
+}
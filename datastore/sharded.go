@@ -0,0 +1,257 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const shardDirFormat = "shard-%d"
+
+// ShardedDb partitions keys by hash across several independent Db instances,
+// each with its own directory and writer goroutine.
+type ShardedDb struct {
+	shards []*Db
+}
+
+// OpenSharded opens n shards under dir. The number of shards must match the
+// one the directory was created with, since keys are routed by hash.
+func OpenSharded(dir string, n int, opts Options) (*ShardedDb, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("OpenSharded: invalid shard count %d", n)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	existing := 0
+	for _, e := range entries {
+		if isShardDir(e) {
+			existing++
+		} else if isLogFile(e) {
+			return nil, fmt.Errorf("OpenSharded: %s contains an unsharded datastore", dir)
+		}
+	}
+	if existing != 0 && existing != n {
+		return nil, fmt.Errorf("OpenSharded: %s contains %d shards, requested %d", dir, existing, n)
+	}
+
+	s := &ShardedDb{shards: make([]*Db, n)}
+	for i := range s.shards {
+		db, err := OpenWithOptions(filepath.Join(dir, fmt.Sprintf(shardDirFormat, i)), opts)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.shards[i] = db
+	}
+	return s, nil
+}
+
+// isShardDir tells whether e is the directory of a shard.
+func isShardDir(e os.DirEntry) bool {
+	var idx int
+	n, _ := fmt.Sscanf(e.Name(), shardDirFormat, &idx)
+	return n == 1 && e.IsDir()
+}
+
+// isLogFile tells whether e is the active file or a segment of a Db.
+func isLogFile(e os.DirEntry) bool {
+	var idx int
+	n, _ := fmt.Sscanf(e.Name(), "seg_%d.dat", &idx)
+	return !e.IsDir() && (n == 1 || e.Name() == outFileName)
+}
+
+func (s *ShardedDb) shardFor(key string) *Db {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *ShardedDb) Put(key, value string) error {
+	return s.shardFor(key).Put(key, value)
+}
+
+func (s *ShardedDb) PutTTL(key, value string, ttl time.Duration) error {
+	return s.shardFor(key).PutTTL(key, value, ttl)
+}
+
+func (s *ShardedDb) PutTyped(key, value, contentType string) error {
+	return s.shardFor(key).PutTyped(key, value, contentType)
+}
+
+func (s *ShardedDb) GetTyped(key string) (string, string, error) {
+	return s.shardFor(key).GetTyped(key)
+}
+
+func (s *ShardedDb) Swap(key, value, contentType string) (bool, error) {
+	return s.shardFor(key).Swap(key, value, contentType)
+}
+
+func (s *ShardedDb) Stat(key string) (ValueInfo, error) {
+	return s.shardFor(key).Stat(key)
+}
+
+func (s *ShardedDb) Update(key string, fn func(value string, found bool) (string, error)) error {
+	return s.shardFor(key).Update(key, fn)
+}
+
+func (s *ShardedDb) Get(key string) (string, error) {
+	return s.shardFor(key).Get(key)
+}
+
+func (s *ShardedDb) Delete(key string) error {
+	return s.shardFor(key).Delete(key)
+}
+
+var errScanStopped = errors.New("scan stopped")
+
+// Scan visits matching keys of all shards in ascending key order. The
+// ordered scans of the shards are merged as they go, one record of each
+// shard at a time.
+func (s *ShardedDb) Scan(prefix string, fn func(key, value string) error) error {
+	type cursor struct {
+		next       func() (string, string, bool)
+		err        error
+		key, value string
+		ok         bool
+	}
+	cursors := make([]*cursor, len(s.shards))
+	for i, db := range s.shards {
+		c := &cursor{}
+		next, stop := iter.Pull2(func(yield func(string, string) bool) {
+			c.err = db.Scan(prefix, func(key, value string) error {
+				if !yield(key, value) {
+					return errScanStopped
+				}
+				return nil
+			})
+		})
+		defer stop()
+		c.next = next
+		cursors[i] = c
+	}
+	advance := func(c *cursor) error {
+		if c.key, c.value, c.ok = c.next(); !c.ok {
+			return c.err
+		}
+		return nil
+	}
+	for _, c := range cursors {
+		if err := advance(c); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var first *cursor
+		for _, c := range cursors {
+			if c.ok && (first == nil || c.key < first.key) {
+				first = c
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if err := fn(first.key, first.value); err != nil {
+			return err
+		}
+		if err := advance(first); err != nil {
+			return err
+		}
+	}
+}
+
+// Stats sums the counters of all shards and lists their segments with the
+// shard directory as a name prefix. Active files of the shards are listed
+// with the closed segments.
+func (s *ShardedDb) Stats() Stats {
+	var st Stats
+	for i, db := range s.shards {
+		shard := db.Stats()
+		st.Engine, st.IndexMode, st.BloomFalsePositiveRate = shard.Engine, shard.IndexMode, shard.BloomFalsePositiveRate
+		st.BloomNegatives += shard.BloomNegatives
+		st.Keys += shard.Keys
+		st.SegmentCount += shard.SegmentCount
+		st.Reads += shard.Reads
+		st.Writes += shard.Writes
+		st.Merges += shard.Merges
+		st.WriteQueueDepth += shard.WriteQueueDepth
+		st.MergeDuration += shard.MergeDuration
+		st.LastMergeDuration = max(st.LastMergeDuration, shard.LastMergeDuration)
+		st.RecoveryDuration += shard.RecoveryDuration
+		segments := shard.Segments
+		if shard.Active != nil {
+			segments = append(segments, *shard.Active)
+		}
+		for _, seg := range segments {
+			seg.Name = filepath.Join(fmt.Sprintf(shardDirFormat, i), seg.Name)
+			st.Segments = append(st.Segments, seg)
+		}
+	}
+	return st
+}
+
+// HotKeys merges the hot keys of all shards. Shards hold disjoint keys, so
+// the merged counts are those of the shards.
+func (s *ShardedDb) HotKeys(n int) (HotKeys, bool) {
+	var res HotKeys
+	for i, db := range s.shards {
+		hot, ok := db.HotKeys(0)
+		if !ok {
+			return HotKeys{}, false
+		}
+		if i == 0 || hot.Since.Before(res.Since) {
+			res.Since = hot.Since
+		}
+		res.SampleRate = hot.SampleRate
+		res.Reads = append(res.Reads, hot.Reads...)
+		res.Writes = append(res.Writes, hot.Writes...)
+	}
+	res.Reads = topKeys(res.Reads, n)
+	res.Writes = topKeys(res.Writes, n)
+	return res, true
+}
+
+func (s *ShardedDb) ResetHotKeys() {
+	for _, db := range s.shards {
+		db.ResetHotKeys()
+	}
+}
+
+func (s *ShardedDb) MergeSegments() error {
+	for _, db := range s.shards {
+		if err := db.MergeSegments(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDb) Ping(ctx context.Context) error {
+	for _, shard := range s.shards {
+		if err := shard.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedDb) Close() error {
+	var errs []error
+	for _, db := range s.shards {
+		if db != nil {
+			errs = append(errs, db.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestShardedDb(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenSharded(dir, 4, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key-%02d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key-07"); err != nil {
+		t.Fatal(err)
+	}
+
+	used := 0
+	for _, shard := range db.shards {
+		if size, _ := shard.Size(); size > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("expected keys to be spread across shards, %d shards used", used)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSharded(dir, 3, Options{}); err == nil {
+		t.Error("expected an error when reopening with a different shard count")
+	}
+	db, err = OpenSharded(dir, 4, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if v, err := db.Get("key-42"); err != nil || v != "42" {
+		t.Errorf("Get(key-42) = (%q, %v) after reopen", v, err)
+	}
+	if _, err := db.Get("key-07"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for deleted key, got %v", err)
+	}
+
+	var keys []string
+	err = db.Scan("key-1", func(key, _ string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 || keys[0] != "key-10" || keys[9] != "key-19" {
+		t.Errorf("unexpected scan result %v", keys)
+	}
+}
+
+func TestShardedDb_Scan(t *testing.T) {
+	db, err := OpenSharded(t.TempDir(), 3, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("k%03d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	if err := db.Scan("", func(key, value string) error {
+		if value != fmt.Sprint(len(keys)) {
+			t.Errorf("%s = %s", key, value)
+		}
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 100 || !sort.StringsAreSorted(keys) {
+		t.Errorf("Scan visited %d keys, sorted: %t", len(keys), sort.StringsAreSorted(keys))
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = db.Scan("", func(string, string) error {
+		if calls++; calls == 10 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 10 {
+		t.Errorf("Scan did not stop on callback error: (%v, %d calls)", err, calls)
+	}
+}
+
+func TestShardedDb_Layout(t *testing.T) {
+	plain := t.TempDir()
+	db, err := Open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSharded(plain, 2, Options{}); err == nil {
+		t.Error("expected an error when sharding an unsharded directory")
+	}
+
+	sharded := t.TempDir()
+	s, err := OpenSharded(sharded, 2, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(sharded); err == nil {
+		t.Error("expected an error when opening a sharded directory as one Db")
+	}
+}
@@ -0,0 +1,380 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const DefaultSparseIndexInterval = 64
+
+// SparseIndexInterval is the number of on-disk index entries per entry of
+// the in-memory summary.
+var SparseIndexInterval = DefaultSparseIndexInterval
+
+const indexSuffix = ".idx"
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// 0    4     kl+4             <-- offset
+// (kl) (key) (record offset)
+// 4    ....  8                <-- length
+
+func (e *indexEntry) Encode() []byte {
+	kl := len(e.key)
+	res := make([]byte, kl+12)
+	binary.LittleEndian.PutUint32(res, uint32(kl))
+	copy(res[4:], e.key)
+	binary.LittleEndian.PutUint64(res[kl+4:], uint64(e.offset))
+	return res
+}
+
+func (e *indexEntry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	var klBuf [4]byte
+	if _, err := io.ReadFull(in, klBuf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("indexEntry, cannot read key length: %w", err)
+	}
+	buf := make([]byte, int(binary.LittleEndian.Uint32(klBuf[:]))+8)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		return 0, fmt.Errorf("indexEntry, cannot read entry: %w", err)
+	}
+	e.key = string(buf[:len(buf)-8])
+	e.offset = int64(binary.LittleEndian.Uint64(buf[len(buf)-8:]))
+	return len(buf) + 4, nil
+}
+
+type summaryEntry struct {
+	key string
+	pos int64
+}
+
+// sparseIndex is the in-memory part of a segment index: every
+// SparseIndexInterval-th key of the sorted on-disk index with its position,
+// and the last key of the index.
+type sparseIndex struct {
+	path    string
+	summary []summaryEntry
+	count   int
+	last    string
+}
+
+func indexPath(segPath string) string {
+	return strings.TrimSuffix(segPath, ".dat") + indexSuffix
+}
+
+// buildSegmentIndex writes the sorted index of a closed segment. Only the
+// latest record of each key is indexed, tombstones included, so that they
+// keep shadowing older segments.
+func buildSegmentIndex(segPath string) (*sparseIndex, error) {
+	r, err := openSegmentReader(segPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	latest := make(map[string]int64)
+	for {
+		rec, offset, err := r.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("buildSegmentIndex: %w", err)
+		}
+		latest[rec.key] = offset
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmp := indexPath(segPath) + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(out)
+	idx := &sparseIndex{path: indexPath(segPath)}
+	var pos int64
+	for _, key := range keys {
+		e := indexEntry{key: key, offset: latest[key]}
+		if idx.count%SparseIndexInterval == 0 {
+			idx.summary = append(idx.summary, summaryEntry{key: key, pos: pos})
+		}
+		n, err := w.Write(e.Encode())
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		pos += int64(n)
+		idx.count++
+		idx.last = key
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, idx.path); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// loadSegmentIndex builds the in-memory summary of a persisted index,
+// creating the index first if it is missing.
+func loadSegmentIndex(segPath string) (*sparseIndex, error) {
+	f, err := os.Open(indexPath(segPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return buildSegmentIndex(segPath)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := &sparseIndex{path: indexPath(segPath)}
+	in := bufio.NewReader(f)
+	var pos int64
+	for {
+		var e indexEntry
+		n, err := e.DecodeFromReader(in)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loadSegmentIndex: %w", err)
+		}
+		if idx.count%SparseIndexInterval == 0 {
+			idx.summary = append(idx.summary, summaryEntry{key: e.key, pos: pos})
+		}
+		pos += int64(n)
+		idx.count++
+		idx.last = e.key
+	}
+	return idx, nil
+}
+
+// block returns the position of the summary block that may hold key.
+func (idx *sparseIndex) block(key string) (int64, bool) {
+	i := sort.Search(len(idx.summary), func(i int) bool { return idx.summary[i].key > key }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return idx.summary[i].pos, true
+}
+
+// find returns the offset of the latest record of key within the segment.
+func (idx *sparseIndex) find(key string) (int64, bool, error) {
+	pos, ok := idx.block(key)
+	if !ok {
+		return 0, false, nil
+	}
+
+	f, err := os.Open(idx.path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+
+	in := bufio.NewReader(f)
+	for i := 0; i < SparseIndexInterval; i++ {
+		var e indexEntry
+		if _, err := e.DecodeFromReader(in); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, false, err
+		}
+		if e.key == key {
+			return e.offset, true, nil
+		}
+		if e.key > key {
+			break
+		}
+	}
+	return 0, false, nil
+}
+
+// keyIterator walks index entries in ascending key order.
+type keyIterator interface {
+	valid() bool
+	current() (string, filePos)
+	next() error
+	close()
+}
+
+type indexIterator struct {
+	f       *os.File
+	in      *bufio.Reader
+	segPath string
+	cur     indexEntry
+	ok      bool
+}
+
+func newIndexIterator(seg *segment, prefix string) (*indexIterator, error) {
+	f, err := os.Open(seg.sparse.path)
+	if err != nil {
+		return nil, err
+	}
+	if pos, ok := seg.sparse.block(prefix); ok {
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	it := &indexIterator{f: f, in: bufio.NewReader(f), segPath: seg.path}
+	for {
+		if err := it.next(); err != nil {
+			it.close()
+			return nil, err
+		}
+		if !it.ok || it.cur.key >= prefix {
+			return it, nil
+		}
+	}
+}
+
+func (it *indexIterator) valid() bool { return it.ok }
+
+func (it *indexIterator) current() (string, filePos) {
+	return it.cur.key, filePos{fileName: it.segPath, offset: it.cur.offset}
+}
+
+func (it *indexIterator) next() error {
+	_, err := it.cur.DecodeFromReader(it.in)
+	if errors.Is(err, io.EOF) {
+		it.ok = false
+		return nil
+	}
+	it.ok = err == nil
+	return err
+}
+
+func (it *indexIterator) close() { it.f.Close() }
+
+type sliceIterator struct {
+	keys      []string
+	positions map[string]filePos
+}
+
+func (it *sliceIterator) valid() bool { return len(it.keys) > 0 }
+
+func (it *sliceIterator) current() (string, filePos) {
+	return it.keys[0], it.positions[it.keys[0]]
+}
+
+func (it *sliceIterator) next() error {
+	it.keys = it.keys[1:]
+	return nil
+}
+
+func (it *sliceIterator) close() {}
+
+// mergeIterators visits every distinct key once with the position from the
+// first iterator holding it, so iterators must be ordered newest first.
+func mergeIterators(its []keyIterator, prefix string, fn func(key string, pos filePos) error) error {
+	for {
+		minKey, found := "", false
+		for _, it := range its {
+			if !it.valid() {
+				continue
+			}
+			if key, _ := it.current(); !found || key < minKey {
+				minKey, found = key, true
+			}
+		}
+		if !found || !strings.HasPrefix(minKey, prefix) {
+			return nil
+		}
+
+		var pos filePos
+		chosen := false
+		for _, it := range its {
+			if !it.valid() {
+				continue
+			}
+			if key, p := it.current(); key == minKey {
+				if !chosen {
+					pos, chosen = p, true
+				}
+				if err := it.next(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := fn(minKey, pos); err != nil {
+			return err
+		}
+	}
+}
+
+func segmentIterators(segments []*segment, prefix string) ([]keyIterator, error) {
+	var its []keyIterator
+	for i := len(segments) - 1; i >= 0; i-- {
+		it, err := newIndexIterator(segments[i], prefix)
+		if err != nil {
+			for _, it := range its {
+				it.close()
+			}
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	return its, nil
+}
+
+func (db *Db) scanSparse(prefix string, fn func(rec entry) error) error {
+	// Index files stay readable through the open iterators when a merge
+	// removes them.
+	db.filesMu.RLock()
+	gen := db.generation
+	db.mu.RLock()
+	active := &sliceIterator{positions: make(map[string]filePos)}
+	for key, pos := range db.index {
+		if strings.HasPrefix(key, prefix) {
+			active.keys = append(active.keys, key)
+			active.positions[key] = pos
+		}
+	}
+	segments := db.segments
+	db.mu.RUnlock()
+	its, err := segmentIterators(segments, prefix)
+	db.filesMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	sort.Strings(active.keys)
+	its = append([]keyIterator{active}, its...)
+	defer func() {
+		for _, it := range its {
+			it.close()
+		}
+	}()
+
+	return mergeIterators(its, prefix, func(key string, pos filePos) error {
+		rec, err := db.readScanned(key, pos, gen)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(rec)
+	})
+}
@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSparseIndexMode(t *testing.T) {
+	dir := t.TempDir()
+
+	oldMax, oldInterval := MaxSegmentSize, SparseIndexInterval
+	MaxSegmentSize, SparseIndexInterval = 512, 4
+	defer func() { MaxSegmentSize, SparseIndexInterval = oldMax, oldInterval }()
+
+	open := func() *Db {
+		db, err := OpenWithOptions(dir, Options{IndexMode: SparseIndexMode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key_%02d", i)
+			value := fmt.Sprintf("v%d-%d", round, i)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+	}
+	for i := 0; i < 40; i += 5 {
+		key := fmt.Sprintf("key_%02d", i)
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key_%02d", i)
+			value, err := db.Get(key)
+			if want, ok := expected[key]; ok {
+				if err != nil || value != want {
+					t.Errorf("Get(%s) = (%q, %v), want %q", key, value, err, want)
+				}
+			} else if err != ErrNotFound {
+				t.Errorf("Get(%s) = (%q, %v), want ErrNotFound", key, value, err)
+			}
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound for a missing key, got %v", err)
+		}
+
+		var scanned []string
+		err := db.Scan("key_1", func(key, value string) error {
+			if expected[key] != value {
+				t.Errorf("Scan returned %s=%q, want %q", key, value, expected[key])
+			}
+			scanned = append(scanned, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(scanned, ",") != "key_11,key_12,key_13,key_14,key_16,key_17,key_18,key_19" {
+			t.Errorf("unexpected scan result %v", scanned)
+		}
+	}
+
+	if len(db.Stats().Segments) < 2 {
+		t.Fatalf("expected several segments, got %+v", db.Stats().Segments)
+	}
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	t.Cleanup(func() { _ = db.Close() })
+	t.Run("reopen", func(t *testing.T) { check(t, db) })
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("merge", func(t *testing.T) { check(t, db) })
+
+	st := db.Stats()
+	if st.IndexMode != "sparse" || len(st.Segments) != 1 || st.Segments[0].SummaryEntries == 0 {
+		t.Errorf("unexpected stats after merge %+v", st)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	const keys = 20000
+
+	oldMax := MaxSegmentSize
+	MaxSegmentSize = 256 * 1024
+	defer func() { MaxSegmentSize = oldMax }()
+
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		b.Run(mode.String(), func(b *testing.B) {
+			dir := b.TempDir()
+			db, err := OpenWithOptions(dir, Options{IndexMode: mode})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprintf("key-%06d", i), "value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				b.Fatal(err)
+			}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			db, err = OpenWithOptions(dir, Options{IndexMode: mode})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("key-%06d", i%keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(after.HeapAlloc)-float64(before.HeapAlloc), "index-bytes")
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type SegmentStats struct {
+	Name                   string  `json:"name"`
+	Level                  int     `json:"level,omitempty"`
+	FormatVersion          uint32  `json:"formatVersion"`
+	TotalBytes             int64   `json:"totalBytes"`
+	LiveBytes              int64   `json:"liveBytes"`
+	DeadBytes              int64   `json:"deadBytes"`
+	BloomKeys              int     `json:"bloomKeys"`
+	BloomBits              uint64  `json:"bloomBits"`
+	BloomHashes            uint32  `json:"bloomHashes"`
+	BloomFalsePositiveRate float64 `json:"bloomFalsePositiveRate"`
+	IndexEntries           int     `json:"indexEntries,omitempty"`
+	SummaryEntries         int     `json:"summaryEntries,omitempty"`
+}
+
+// Stats is a point-in-time view of a store. Live bytes are taken by the
+// latest record of every key that is not a tombstone; records whose TTL
+// elapsed count as live until a merge drops them.
+type Stats struct {
+	Engine                 string  `json:"engine"`
+	LastSeq                uint64  `json:"lastSeq,omitempty"`
+	IndexMode              string  `json:"indexMode"`
+	Keys                   int     `json:"keys"`
+	SegmentCount           int     `json:"segmentCount"`
+	Reads                  uint64  `json:"reads"`
+	Writes                 uint64  `json:"writes"`
+	Merges                 uint64  `json:"merges"`
+	WriteQueueDepth        int64   `json:"writeQueueDepth"`
+	BloomFalsePositiveRate float64 `json:"bloomFalsePositiveRate"`
+	BloomNegatives         uint64  `json:"bloomNegatives"`
+
+	MergeDuration     time.Duration `json:"mergeDuration"`
+	LastMergeDuration time.Duration `json:"lastMergeDuration"`
+	RecoveryDuration  time.Duration `json:"recoveryDuration"`
+
+	// Active is the file currently written to, Segments are the closed ones.
+	Active   *SegmentStats  `json:"active,omitempty"`
+	Segments []SegmentStats `json:"segments"`
+}
+
+func (db *Db) Stats() Stats {
+	st := Stats{
+		Engine:                 "log",
+		LastSeq:                db.LastSeq(),
+		IndexMode:              db.opts.IndexMode.String(),
+		Reads:                  db.reads.Load(),
+		Writes:                 db.writes.Load(),
+		Merges:                 db.merges.Load(),
+		WriteQueueDepth:        db.pendingWrites.Load(),
+		BloomFalsePositiveRate: db.opts.bloomFalsePositiveRate(),
+		BloomNegatives:         db.bloomNegatives.Load(),
+		MergeDuration:          time.Duration(db.mergeTime.Load()),
+		LastMergeDuration:      time.Duration(db.lastMergeTime.Load()),
+		RecoveryDuration:       db.recoveryDuration,
+	}
+
+	db.mu.RLock()
+	for _, u := range db.usage {
+		st.Keys += u.keys
+	}
+	active := SegmentStats{
+		Name:          outFileName,
+		TotalBytes:    db.outOffset,
+		FormatVersion: db.outVersion,
+		LiveBytes:     db.usage[filepath.Join(db.dir, outFileName)].bytes,
+	}
+	active.DeadBytes = active.TotalBytes - active.LiveBytes
+	st.Active = &active
+	for _, seg := range db.segments {
+		ss := seg.stats()
+		ss.LiveBytes = db.usage[seg.path].bytes
+		ss.DeadBytes = ss.TotalBytes - ss.LiveBytes
+		st.Segments = append(st.Segments, ss)
+	}
+	db.mu.RUnlock()
+	st.SegmentCount = len(st.Segments)
+	return st
+}
+
+// fileUsage counts the live records of a data file and the bytes they take.
+type fileUsage struct {
+	keys  int
+	bytes int64
+}
+
+// addUsage adds keys and bytes to the usage of file. The caller holds mu.
+func (db *Db) addUsage(file string, keys int, bytes int64) {
+	u := db.usage[file]
+	u.keys += keys
+	u.bytes += bytes
+	db.usage[file] = u
+}
+
+// countUsage computes the usage of every data file from scratch. It runs
+// once on open, after which the writer keeps the counts up to date. In
+// sparse mode the on-disk indexes are merged and record headers of closed
+// segments are read, so the cost grows with the key count.
+func (db *Db) countUsage() (map[string]fileUsage, error) {
+	usage := make(map[string]fileUsage)
+	if db.opts.IndexMode == HashIndexMode {
+		for _, pos := range db.index {
+			u := usage[pos.fileName]
+			u.keys++
+			u.bytes += pos.size
+			usage[pos.fileName] = u
+		}
+		return usage, nil
+	}
+
+	active := &sliceIterator{positions: make(map[string]filePos, len(db.index))}
+	for key, pos := range db.index {
+		active.keys = append(active.keys, key)
+		active.positions[key] = pos
+	}
+	sort.Strings(active.keys)
+
+	its, err := segmentIterators(db.segments, "")
+	if err != nil {
+		return nil, err
+	}
+	its = append([]keyIterator{active}, its...)
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, it := range its {
+			it.close()
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	err = mergeIterators(its, "", func(key string, pos filePos) error {
+		f, ok := files[pos.fileName]
+		if !ok {
+			var err error
+			if f, err = os.Open(pos.fileName); err != nil {
+				return err
+			}
+			files[pos.fileName] = f
+		}
+		size, live, err := readRecordSize(f, pos.offset, key)
+		if err != nil {
+			return err
+		}
+		if live {
+			u := usage[pos.fileName]
+			u.keys++
+			u.bytes += size
+			usage[pos.fileName] = u
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// readRecordSize reads the size of the record of key at offset in f and
+// whether it is live, i.e. not a tombstone, from the record header only.
+func readRecordSize(f *os.File, offset int64, key string) (int64, bool, error) {
+	buf := make([]byte, len(key)+12)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return 0, false, err
+	}
+	return int64(binary.LittleEndian.Uint32(buf)), binary.LittleEndian.Uint32(buf[len(key)+8:]) != 0, nil
+}
+
+// recordRef is the latest record of a key in a data file.
+type recordRef struct {
+	file string
+	size int64
+	live bool
+}
+
+// replacedRecords returns, for every record, the latest record of its key
+// before it, which may be an earlier record of the same request written to
+// currFile. Only the writer calls it, so the files it reads do not change
+// meanwhile.
+func (db *Db) replacedRecords(records []entry, currFile string) ([]recordRef, error) {
+	refs := make([]recordRef, len(records))
+	last := make(map[string]int, len(records))
+	for i, rec := range records {
+		if j, ok := last[rec.key]; ok {
+			prev := records[j]
+			refs[i] = recordRef{file: currFile, size: int64(len(prev.Encode())), live: prev.value != ""}
+		} else {
+			ref, err := db.latestRecord(rec.key)
+			if err != nil {
+				return nil, err
+			}
+			refs[i] = ref
+		}
+		last[rec.key] = i
+	}
+	return refs, nil
+}
+
+func (db *Db) latestRecord(key string) (recordRef, error) {
+	pos, ok, err := db.locate(key)
+	if err != nil || !ok {
+		return recordRef{}, err
+	}
+	if db.opts.IndexMode == HashIndexMode {
+		// The hash index only holds live records.
+		return recordRef{file: pos.fileName, size: pos.size, live: true}, nil
+	}
+	f, err := os.Open(pos.fileName)
+	if err != nil {
+		return recordRef{}, err
+	}
+	defer f.Close()
+	size, live, err := readRecordSize(f, pos.offset, key)
+	return recordRef{file: pos.fileName, size: size, live: live}, err
+}
+
+func (seg *segment) stats() SegmentStats {
+	ss := SegmentStats{
+		Name:          filepath.Base(seg.path),
+		TotalBytes:    seg.size,
+		FormatVersion: seg.version,
+	}
+	if seg.filter != nil {
+		ss.BloomKeys = seg.filter.count
+		ss.BloomBits = seg.filter.m
+		ss.BloomHashes = seg.filter.k
+		ss.BloomFalsePositiveRate = seg.filter.estimatedFalsePositiveRate()
+	}
+	if seg.sparse != nil {
+		ss.IndexEntries = seg.sparse.count
+		ss.SummaryEntries = len(seg.sparse.summary)
+	}
+	return ss
+}
+
+func segmentNumber(name string) int {
+	var idx int
+	if n, _ := fmt.Sscanf(filepath.Base(name), "seg_%d.dat", &idx); n != 1 {
+		return -1
+	}
+	return idx
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+)
+
+func TestDb_Stats(t *testing.T) {
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) {
+			saved := MaxSegmentSize
+			MaxSegmentSize = 128
+			t.Cleanup(func() { MaxSegmentSize = saved })
+
+			db, err := OpenWithOptions(t.TempDir(), Options{IndexMode: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Delete("key0"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Get("key1"); err != nil {
+				t.Fatal(err)
+			}
+
+			st := db.Stats()
+			if st.Keys != 9 {
+				t.Errorf("expected 9 keys, got %d", st.Keys)
+			}
+			if st.Writes != 21 || st.Reads != 1 {
+				t.Errorf("unexpected op counters: %d writes, %d reads", st.Writes, st.Reads)
+			}
+			if st.SegmentCount < 2 || st.SegmentCount != len(st.Segments) {
+				t.Errorf("unexpected segment count %d for %d segments", st.SegmentCount, len(st.Segments))
+			}
+			deadBytes := func(st Stats) (dead int64) {
+				for _, seg := range append(st.Segments, *st.Active) {
+					dead += seg.DeadBytes
+				}
+				return dead
+			}
+			var total, live int64
+			for _, seg := range append(st.Segments, *st.Active) {
+				if seg.LiveBytes+seg.DeadBytes != seg.TotalBytes {
+					t.Errorf("segment %s: live %d + dead %d != total %d", seg.Name, seg.LiveBytes, seg.DeadBytes, seg.TotalBytes)
+				}
+				total += seg.TotalBytes
+				live += seg.LiveBytes
+			}
+			if live == 0 || live >= total {
+				t.Errorf("expected both live and dead data, got %d live of %d bytes", live, total)
+			}
+			if st.RecoveryDuration <= 0 {
+				t.Errorf("recovery duration is not recorded")
+			}
+
+			if err := db.MergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			dead := deadBytes(st)
+			st = db.Stats()
+			if st.Merges != 1 || st.LastMergeDuration <= 0 || st.MergeDuration != st.LastMergeDuration {
+				t.Errorf("unexpected merge stats: %+v", st)
+			}
+			if st.Keys != 9 {
+				t.Errorf("expected 9 keys after merge, got %d", st.Keys)
+			}
+			if len(st.Segments) != 1 || deadBytes(st) >= dead {
+				t.Errorf("expected merge to reclaim dead bytes, got %+v", st.Segments)
+			}
+		})
+	}
+}
+
+// TestDb_StatsUsage checks the live byte counters that writes, rotations and
+// merges keep up to date against a count from scratch.
+func TestDb_StatsUsage(t *testing.T) {
+	for _, mode := range []IndexMode{HashIndexMode, SparseIndexMode} {
+		t.Run(mode.String(), func(t *testing.T) {
+			saved := MaxSegmentSize
+			MaxSegmentSize = 256
+			t.Cleanup(func() { MaxSegmentSize = saved })
+
+			dir := t.TempDir()
+			db, err := OpenWithOptions(dir, Options{IndexMode: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+
+			check := func(step string) {
+				t.Helper()
+				var got, want map[string]fileUsage
+				err := db.run(func() (err error) {
+					got = make(map[string]fileUsage)
+					for file, u := range db.usage {
+						if u != (fileUsage{}) {
+							got[file] = u
+						}
+					}
+					want, err = db.countUsage()
+					return err
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !maps.Equal(got, want) {
+					t.Errorf("%s: usage %v, counted %v", step, got, want)
+				}
+			}
+
+			for i := 0; i < 30; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i%12), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check("puts")
+			b := new(Batch)
+			b.Put("key1", "batch1")
+			b.Delete("key1")
+			b.Put("key2", "batch2")
+			b.Put("key2", "batch3")
+			b.Delete("key3")
+			b.Delete("missing")
+			if err := db.Write(b); err != nil {
+				t.Fatal(err)
+			}
+			check("batch")
+
+			if err := db.MergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			check("merge")
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i%7), fmt.Sprintf("after%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Delete("key4"); err != nil {
+				t.Fatal(err)
+			}
+			check("writes after merge")
+			if err := db.MergeSegments(); err != nil {
+				t.Fatal(err)
+			}
+			check("second merge")
+
+			keys := db.Stats().Keys
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if db, err = OpenWithOptions(dir, Options{IndexMode: mode}); err != nil {
+				t.Fatal(err)
+			}
+			if st := db.Stats(); st.Keys != keys || st.Keys != 11 {
+				t.Errorf("expected %d keys after reopen, got %d", keys, st.Keys)
+			}
+		})
+	}
+}
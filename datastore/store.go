@@ -0,0 +1,32 @@
+package datastore
+
+import "context"
+
+// Store is the storage engine API used by the DB service. Deleted and
+// missing keys are both reported with ErrNotFound.
+type Store interface {
+	Put(key, value string) error
+	Get(key string) (string, error)
+	Delete(key string) error
+	Scan(prefix string, fn func(key, value string) error) error
+	Close() error
+	Stats() Stats
+}
+
+// Pinger is implemented by stores with a writer goroutine, which Ping checks
+// to be accepting requests.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+var (
+	_ Pinger = (*Db)(nil)
+	_ Pinger = (*ShardedDb)(nil)
+)
+
+var (
+	_ Store = (*Db)(nil)
+	_ Store = (*ShardedDb)(nil)
+	_ Store = (*LSMStore)(nil)
+	_ Store = (*MemStore)(nil)
+)
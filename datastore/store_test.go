@@ -0,0 +1,45 @@
+package datastore_test
+
+import (
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/datastore/storetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	oldSegment := datastore.MaxSegmentSize
+	oldMemtable, oldTable, oldBase := datastore.LSMMemtableSize, datastore.LSMTableSize, datastore.LSMLevelBaseSize
+	datastore.MaxSegmentSize = 4 * 1024
+	datastore.LSMMemtableSize, datastore.LSMTableSize, datastore.LSMLevelBaseSize = 2*1024, 4*1024, 16*1024
+	defer func() {
+		datastore.MaxSegmentSize = oldSegment
+		datastore.LSMMemtableSize, datastore.LSMTableSize, datastore.LSMLevelBaseSize = oldMemtable, oldTable, oldBase
+	}()
+
+	t.Run("hash", func(t *testing.T) {
+		storetest.RunPersistent(t, func(dir string) (datastore.Store, error) {
+			return datastore.Open(dir)
+		})
+	})
+	t.Run("sparse", func(t *testing.T) {
+		storetest.RunPersistent(t, func(dir string) (datastore.Store, error) {
+			return datastore.OpenWithOptions(dir, datastore.Options{IndexMode: datastore.SparseIndexMode})
+		})
+	})
+	t.Run("sharded", func(t *testing.T) {
+		storetest.RunPersistent(t, func(dir string) (datastore.Store, error) {
+			return datastore.OpenSharded(dir, 3, datastore.Options{})
+		})
+	})
+	t.Run("memory", func(t *testing.T) {
+		storetest.Run(t, func(string) (datastore.Store, error) {
+			return datastore.NewMemStore(), nil
+		})
+	})
+	t.Run("lsm", func(t *testing.T) {
+		storetest.RunPersistent(t, func(dir string) (datastore.Store, error) {
+			return datastore.OpenLSM(dir)
+		})
+	})
+}
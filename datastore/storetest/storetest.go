@@ -0,0 +1,401 @@
+// Package storetest holds the conformance suite every datastore.Store
+// implementation has to pass.
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// Opener opens a store in dir. It is called again with the same directory
+// to check persistence, so it must not clear the directory.
+type Opener func(dir string) (datastore.Store, error)
+
+// Run checks the semantics shared by all stores. Batches, transactions, TTL,
+// Swap and Stat are only checked for stores implementing
+// datastore.BatchWriter, datastore.Transactor, datastore.TTLWriter,
+// datastore.Swapper and datastore.Stater.
+func Run(t *testing.T, open Opener) {
+	t.Run("put/get", func(t *testing.T) { testPutGet(t, open) })
+	t.Run("delete", func(t *testing.T) { testDelete(t, open) })
+	t.Run("scan", func(t *testing.T) { testScan(t, open) })
+	t.Run("batch", func(t *testing.T) { testBatch(t, open) })
+	t.Run("transact", func(t *testing.T) { testTransact(t, open) })
+	t.Run("ttl", func(t *testing.T) { testTTL(t, open) })
+	t.Run("swap", func(t *testing.T) { testSwap(t, open) })
+	t.Run("stat", func(t *testing.T) { testStat(t, open) })
+	t.Run("many keys", func(t *testing.T) { testManyKeys(t, open, false) })
+}
+
+// RunPersistent additionally checks that data survives reopening the store
+// in the same directory.
+func RunPersistent(t *testing.T, open Opener) {
+	Run(t, open)
+	t.Run("reopen", func(t *testing.T) { testReopen(t, open) })
+	t.Run("many keys reopen", func(t *testing.T) { testManyKeys(t, open, true) })
+}
+
+func mustOpen(t *testing.T, open Opener, dir string) datastore.Store {
+	t.Helper()
+	s, err := open(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return s
+}
+
+func expectValue(t *testing.T, s datastore.Store, key, want string) {
+	t.Helper()
+	got, err := s.Get(key)
+	if err != nil {
+		t.Errorf("Get(%q) failed: %v", key, err)
+	} else if got != want {
+		t.Errorf("Get(%q) = %q, want %q", key, got, want)
+	}
+}
+
+func expectNotFound(t *testing.T, s datastore.Store, key string) {
+	t.Helper()
+	if v, err := s.Get(key); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Get(%q) = (%q, %v), want ErrNotFound", key, v, err)
+	}
+}
+
+func scanKeys(t *testing.T, s datastore.Store, prefix string) []string {
+	t.Helper()
+	var res []string
+	err := s.Scan(prefix, func(key, value string) error {
+		res = append(res, key+"="+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan(%q) failed: %v", prefix, err)
+	}
+	return res
+}
+
+func testPutGet(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+
+	expectNotFound(t, s, "k1")
+	for _, pair := range [][]string{{"k1", "v1"}, {"k2", "v2"}, {"k1", "v1.1"}} {
+		if err := s.Put(pair[0], pair[1]); err != nil {
+			t.Fatalf("Put(%q) failed: %v", pair[0], err)
+		}
+		expectValue(t, s, pair[0], pair[1])
+	}
+	expectValue(t, s, "k1", "v1.1")
+	expectValue(t, s, "k2", "v2")
+}
+
+func testDelete(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+
+	if err := s.Put("dx", "toDelete"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("dx"); err != nil {
+		t.Fatal(err)
+	}
+	expectNotFound(t, s, "dx")
+	if err := s.Delete("never-existed"); err != nil {
+		t.Errorf("Delete of a missing key failed: %v", err)
+	}
+	if err := s.Put("dx", "again"); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, s, "dx", "again")
+}
+
+func testScan(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+
+	for _, key := range []string{"b/2", "a/1", "b/1", "b/3", "c"} {
+		if err := s.Put(key, "v"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("b/3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(scanKeys(t, s, "b/"), ","); got != "b/1=vb/1,b/2=vb/2" {
+		t.Errorf("Scan(b/) = %s", got)
+	}
+	if got := len(scanKeys(t, s, "")); got != 4 {
+		t.Errorf("Scan of all keys returned %d records, want 4", got)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := s.Scan("", func(string, string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Scan did not stop on callback error: (%v, %d calls)", err, calls)
+	}
+}
+
+func testBatch(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+	w, ok := s.(datastore.BatchWriter)
+	if !ok {
+		t.Skip("store does not support batches")
+	}
+
+	if err := s.Put("gone", "value"); err != nil {
+		t.Fatal(err)
+	}
+	var b datastore.Batch
+	b.Put("a", "1")
+	b.Put("b", "2")
+	b.Put("a", "1.1")
+	b.Delete("gone")
+	if err := w.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectValue(t, s, "a", "1.1")
+	expectValue(t, s, "b", "2")
+	expectNotFound(t, s, "gone")
+
+	var invalid datastore.Batch
+	invalid.Put("c", "3")
+	invalid.PutTTL("d", "4", 0)
+	if err := w.Write(&invalid); !errors.Is(err, datastore.ErrInvalidTTL) {
+		t.Errorf("expected ErrInvalidTTL for a batch with a bad TTL, got %v", err)
+	}
+	expectNotFound(t, s, "c")
+
+	if err := w.Write(&datastore.Batch{}); err != nil {
+		t.Errorf("empty batch failed: %v", err)
+	}
+}
+
+func testTransact(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+	tr, ok := s.(datastore.Transactor)
+	if !ok {
+		t.Skip("store does not support transactions")
+	}
+
+	if err := s.Put("a", "old"); err != nil {
+		t.Fatal(err)
+	}
+	var reads []string
+	read := func(tx *datastore.Txn, key string) {
+		v, err := tx.Get(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			v = "-"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		reads = append(reads, v)
+	}
+	if err := tr.Transact(func(tx *datastore.Txn) error {
+		read(tx, "a")
+		tx.Put("a", "new")
+		read(tx, "a")
+		tx.Delete("a")
+		read(tx, "a")
+		read(tx, "b")
+		tx.Put("b", "1")
+		read(tx, "b")
+		return nil
+	}); err != nil {
+		t.Fatalf("Transact failed: %v", err)
+	}
+	if got := strings.Join(reads, ","); got != "old,new,-,-,1" {
+		t.Errorf("reads in order returned %s", got)
+	}
+	expectNotFound(t, s, "a")
+	expectValue(t, s, "b", "1")
+
+	failed := errors.New("failed")
+	if err := tr.Transact(func(tx *datastore.Txn) error {
+		tx.Put("c", "3")
+		return failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+	expectNotFound(t, s, "c")
+}
+
+func testTTL(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+	w, ok := s.(datastore.TTLWriter)
+	if !ok {
+		t.Skip("store does not support TTL")
+	}
+
+	if err := w.PutTTL("short", "v", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.PutTTL("long", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.PutTTL("bad", "v", -time.Second); !errors.Is(err, datastore.ErrInvalidTTL) {
+		t.Errorf("expected ErrInvalidTTL, got %v", err)
+	}
+	expectValue(t, s, "short", "v")
+
+	time.Sleep(100 * time.Millisecond)
+	expectNotFound(t, s, "short")
+	expectValue(t, s, "long", "v")
+	if got := scanKeys(t, s, ""); strings.Join(got, ",") != "long=v" {
+		t.Errorf("Scan returned expired records: %v", got)
+	}
+
+	if err := s.Put("long", "forever"); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, s, "long", "forever")
+}
+
+func testSwap(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+	w, ok := s.(datastore.Swapper)
+	if !ok {
+		t.Skip("store does not support Swap")
+	}
+
+	steps := []struct {
+		value string
+		found bool
+	}{
+		{"", false},
+		{"v1", false},
+		{"v2", true},
+		{"", true},
+		{"", false},
+	}
+	for _, st := range steps {
+		found, err := w.Swap("k", st.value, "")
+		if err != nil {
+			t.Fatalf("Swap(%q) failed: %v", st.value, err)
+		}
+		if found != st.found {
+			t.Errorf("Swap(%q) found = %t, expected %t", st.value, found, st.found)
+		}
+		if st.value == "" {
+			expectNotFound(t, s, "k")
+		} else {
+			expectValue(t, s, "k", st.value)
+		}
+	}
+}
+
+func testStat(t *testing.T, open Opener) {
+	s := mustOpen(t, open, t.TempDir())
+	defer s.Close()
+	st, ok := s.(datastore.Stater)
+	if !ok {
+		t.Skip("store does not support Stat")
+	}
+
+	if _, err := st.Stat("k"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Stat of a missing key: expected ErrNotFound, got %v", err)
+	}
+	if err := s.Put("k", "value"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := st.Stat("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != len("value") || !info.ExpiresAt.IsZero() {
+		t.Errorf("Stat = %+v", info)
+	}
+	if err := s.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Stat("k"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Stat of a deleted key: expected ErrNotFound, got %v", err)
+	}
+}
+
+func testReopen(t *testing.T, open Opener) {
+	dir := t.TempDir()
+	s := mustOpen(t, open, dir)
+	if err := s.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("removed", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("removed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = mustOpen(t, open, dir)
+	defer s.Close()
+	expectValue(t, s, "kept", "value")
+	expectNotFound(t, s, "removed")
+}
+
+// testManyKeys writes enough data to make file-backed engines rotate,
+// flush or compact, depending on the limits configured by the caller.
+func testManyKeys(t *testing.T, open Opener, reopen bool) {
+	dir := t.TempDir()
+	s := mustOpen(t, open, dir)
+
+	const n = 500
+	value := strings.Repeat("x", 64)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < n; i++ {
+			if err := s.Put(fmt.Sprintf("key-%04d", i), fmt.Sprintf("%s-%d", value, round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if err := s.Delete(fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			if i%3 == 0 {
+				expectNotFound(t, s, key)
+			} else {
+				expectValue(t, s, key, value+"-1")
+			}
+		}
+		if got := len(scanKeys(t, s, "key-")); got != n-(n+2)/3 {
+			t.Errorf("Scan returned %d records, want %d", got, n-(n+2)/3)
+		}
+	}
+	check()
+	if !reopen {
+		_ = s.Close()
+		return
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = mustOpen(t, open, dir)
+	defer s.Close()
+	check()
+
+	if st := s.Stats(); st.Engine == "" {
+		t.Errorf("Stats does not report the engine: %+v", st)
+	}
+}
@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDb_SyncPolicy(t *testing.T) {
+	for _, opts := range []Options{
+		{Sync: SyncAlways},
+		{Sync: SyncInterval, SyncInterval: time.Millisecond},
+	} {
+		t.Run(opts.Sync.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprint("key", i), "v"); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if v, err := db.Get("key19"); err != nil || v != "v" {
+				t.Errorf("Get after reopen = (%q, %v)", v, err)
+			}
+		})
+	}
+
+	if _, err := OpenWithOptions(t.TempDir(), Options{Sync: SyncInterval}); err == nil {
+		t.Error("expected an error for the interval policy without an interval")
+	}
+}
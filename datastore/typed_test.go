@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDb_PutTyped(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	png := "\x89PNG\r\n\x1a\n\x00\xff"
+	if err := db.PutTyped("image", png, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update("image", func(value string, _ bool) (string, error) {
+		return value + "\x00", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		if v, ct, err := db.GetTyped("image"); err != nil || v != png+"\x00" || ct != "image/png" {
+			t.Errorf("GetTyped(image) = %q, %q, %v", v, ct, err)
+		}
+		if v, ct, err := db.GetTyped("plain"); err != nil || v != "text" || ct != "" {
+			t.Errorf("GetTyped(plain) = %q, %q, %v", v, ct, err)
+		}
+		if _, _, err := db.GetTyped("missing"); err != ErrNotFound {
+			t.Errorf("GetTyped(missing) = %v", err)
+		}
+	}
+	check(db)
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	check(db)
+}
+
+func TestDb_StatTyped(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if err := db.PutTypedTTL("image", "\x89PNG", "image/png", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.Stat("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 4 || info.ContentType != "image/png" || info.ExpiresAt.IsZero() {
+		t.Errorf("Stat(image) = %+v", info)
+	}
+
+	if found, err := db.Swap("image", "GIF89a", "image/gif"); err != nil || !found {
+		t.Fatalf("Swap = %t, %v", found, err)
+	}
+	info, err = db.Stat("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 6 || info.ContentType != "image/gif" || !info.ExpiresAt.IsZero() {
+		t.Errorf("Stat after Swap = %+v", info)
+	}
+}
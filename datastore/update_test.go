@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_Update(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	incr := func(value string, found bool) (string, error) {
+		if !found {
+			return "1", nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n + 1), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := db.Update("counter", incr); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := db.Get("counter"); v != "200" {
+		t.Errorf("counter = %q after concurrent updates", v)
+	}
+
+	errBad := errors.New("bad value")
+	if err := db.Update("counter", func(string, bool) (string, error) { return "", errBad }); err != errBad {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+	if v, _ := db.Get("counter"); v != "200" {
+		t.Errorf("failed update changed the value to %q", v)
+	}
+
+	if err := db.PutTTL("temp", "1", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update("temp", incr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if _, err := db.Get("temp"); err != ErrNotFound {
+		t.Errorf("update dropped the TTL, Get returned %v", err)
+	}
+
+	if err := db.Update("counter", func(string, bool) (string, error) { return "", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("counter"); err != ErrNotFound {
+		t.Errorf("empty value did not delete the key: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWatchHistorySize = 1024
+	watchBufferSize         = 256
+)
+
+var WatchHistorySize = DefaultWatchHistorySize
+
+var ErrWatchPositionLost = fmt.Errorf("watch position is no longer available")
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+type Event struct {
+	Seq   uint64
+	Type  EventType
+	Key   string
+	Value string
+	// ExpiresAt is zero for values without TTL.
+	ExpiresAt time.Time
+	// ContentType is empty for values stored without a media type.
+	ContentType string
+}
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// watchHub fans committed writes out to watchers and keeps a bounded history
+// of recent events so that a watcher can resume from a known sequence number.
+type watchHub struct {
+	mu       sync.Mutex
+	seq      uint64
+	history  []Event
+	watchers map[*watcher]struct{}
+	closed   bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+// event describes the write of rec.
+func (rec entry) event() Event {
+	ev := Event{Seq: rec.seq, Type: EventPut, Key: rec.key, Value: rec.value, ContentType: rec.contentType}
+	if rec.value == "" {
+		ev.Type = EventDelete
+	}
+	if rec.expiresAt != 0 {
+		ev.ExpiresAt = time.Unix(0, rec.expiresAt)
+	}
+	return ev
+}
+
+func (h *watchHub) publish(rec entry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq = rec.seq
+	ev := rec.event()
+
+	h.history = append(h.history, ev)
+	if len(h.history) > WatchHistorySize {
+		h.history = h.history[len(h.history)-WatchHistorySize:]
+	}
+
+	for w := range h.watchers {
+		if !strings.HasPrefix(rec.key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			// The watcher does not keep up; drop it so that the writer never
+			// blocks. The consumer can resume from the last sequence it saw.
+			delete(h.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+func (h *watchHub) lastSeq() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq
+}
+
+func (h *watchHub) watch(ctx context.Context, prefix string, after uint64) (<-chan Event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, fmt.Errorf("watch: database is closed")
+	}
+	if after > h.seq {
+		return nil, fmt.Errorf("watch: position %d is ahead of the log (%d)", after, h.seq)
+	}
+	oldest := h.seq - uint64(len(h.history))
+	if after < oldest {
+		return nil, ErrWatchPositionLost
+	}
+
+	var replay []Event
+	for _, ev := range h.history[len(h.history)-int(h.seq-after):] {
+		if strings.HasPrefix(ev.Key, prefix) {
+			replay = append(replay, ev)
+		}
+	}
+
+	w := &watcher{prefix: prefix, ch: make(chan Event, len(replay)+watchBufferSize)}
+	for _, ev := range replay {
+		w.ch <- ev
+	}
+	h.watchers[w] = struct{}{}
+
+	context.AfterFunc(ctx, func() { h.unsubscribe(w) })
+	return w.ch, nil
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+func (h *watchHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// Watch streams put and delete events for keys starting with prefix that were
+// committed after the given sequence number. Pass LastSeq() to receive only
+// new events. The channel is closed when ctx is done, when the database is
+// closed, or when the consumer falls too far behind.
+func (db *Db) Watch(ctx context.Context, prefix string, after uint64) (<-chan Event, error) {
+	return db.watch.watch(ctx, prefix, after)
+}
+
+func (db *Db) LastSeq() uint64 {
+	return db.watch.lastSeq()
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("watch channel closed unexpectedly")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestDb_Watch(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := db.Watch(ctx, "cfg/", db.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("cfg/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("cfg/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := receive(t, events)
+	if ev.Type != EventPut || ev.Key != "cfg/a" || ev.Value != "1" || ev.Seq != 2 {
+		t.Errorf("unexpected first event %+v", ev)
+	}
+	ev = receive(t, events)
+	if ev.Type != EventDelete || ev.Key != "cfg/a" || ev.Seq != 3 {
+		t.Errorf("unexpected second event %+v", ev)
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		resumed, err := db.Watch(ctx, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev := receive(t, resumed); ev.Seq != 2 {
+			t.Errorf("expected replay to start at seq 2, got %+v", ev)
+		}
+		if ev := receive(t, resumed); ev.Seq != 3 {
+			t.Errorf("expected replay to continue with seq 3, got %+v", ev)
+		}
+	})
+
+	t.Run("position lost", func(t *testing.T) {
+		oldSize := WatchHistorySize
+		WatchHistorySize = 2
+		defer func() { WatchHistorySize = oldSize }()
+
+		if err := db.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Watch(ctx, "", 0); err != ErrWatchPositionLost {
+			t.Errorf("expected ErrWatchPositionLost, got %v", err)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		cctx, ccancel := context.WithCancel(context.Background())
+		ch, err := db.Watch(cctx, "", db.LastSeq())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ccancel()
+		select {
+		case _, ok := <-ch:
+			if ok {
+				t.Error("expected channel to be closed after cancel")
+			}
+		case <-time.After(time.Second):
+			t.Error("channel was not closed after cancel")
+		}
+	})
+}
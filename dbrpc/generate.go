@@ -0,0 +1,5 @@
+// Package dbrpc holds the gRPC API of the DB service and its generated
+// client and server code.
+package dbrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative db.proto
@@ -0,0 +1,142 @@
+package integration
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/tlstest"
+)
+
+// TestMutualTLS runs the DB service with mutual TLS and a server calling
+// it, both with certificates of a CA created for the test.
+func TestMutualTLS(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go command is needed to build the services")
+	}
+	bin := t.TempDir()
+	build := exec.Command("go", "build", "-o", bin, "../cmd/db", "../cmd/server")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("cannot build the services: %v\n%s", err, out)
+	}
+
+	ca := tlstest.NewCA(t)
+	dbCert, dbKey := ca.Issue(t, "db", "127.0.0.1", "localhost")
+	serverCert, serverKey := ca.Issue(t, "server")
+	dbAddr := freeAddr(t)
+	start(t, filepath.Join(bin, "db"), nil,
+		"-data-dir", t.TempDir(),
+		"-listen-addr", dbAddr,
+		"-grpc-addr", "",
+		"-tls-cert", dbCert,
+		"-tls-key", dbKey,
+		"-tls-client-ca", ca.CertFile,
+	)
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbURL := "https://" + dbAddr
+	client := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.Pool(),
+			Certificates: []tls.Certificate{cert},
+		}},
+	}
+	waitFor(t, client, dbURL+"/health")
+
+	anonymous := &http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool()}},
+	}
+	if _, err := anonymous.Get(dbURL + "/health"); err == nil {
+		t.Error("the DB accepted a client without a certificate")
+	}
+	if resp, err := http.Get("http://" + dbAddr + "/health"); err == nil && resp.StatusCode == http.StatusOK {
+		t.Error("the DB answered plaintext HTTP")
+	}
+
+	serverAddr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(serverAddr)
+	start(t, filepath.Join(bin, "server"), []string{
+		"CONF_DB_URL=" + dbURL,
+		"CONF_DB_CA_FILE=" + ca.CertFile,
+		"CONF_DB_CERT_FILE=" + serverCert,
+		"CONF_DB_KEY_FILE=" + serverKey,
+	}, "-port", port)
+
+	// The server stores the current date on start and reads it back
+	// through the DB service.
+	url := "http://" + serverAddr + "/api/v1/some-data?key=los_polos"
+	waitFor(t, http.DefaultClient, url)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if today := time.Now().Format("2006-01-02"); !strings.Contains(string(body), today) {
+		t.Errorf("server returned %s, expected the date %s", body, today)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// start runs a service until the end of the test.
+func start(t *testing.T, path string, env []string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+		}
+	})
+}
+
+func waitFor(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	var lastErr error
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		lastErr = err
+	}
+	t.Fatalf("%s is not available: %v", url, lastErr)
+}
@@ -0,0 +1,260 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+var RetryDelay = time.Second
+
+var errResync = errors.New("replication: follower must be bootstrapped again")
+
+type Status struct {
+	LeaderURL    string    `json:"leader"`
+	Bootstrapped bool      `json:"bootstrapped"`
+	AppliedSeq   uint64    `json:"appliedSeq"`
+	LeaderSeq    uint64    `json:"leaderSeq"`
+	Lag          uint64    `json:"lag"`
+	LastContact  time.Time `json:"lastContact"`
+}
+
+// Follower keeps a local datastore in sync with a leader served by
+// NewLeaderHandler. Sequence numbers tracked here are the leader's ones.
+type Follower struct {
+	leaderURL string
+	db        *datastore.Db
+	client    *http.Client
+	authToken string
+
+	mu           sync.Mutex
+	bootstrapped bool
+	applied      uint64
+	leaderSeq    uint64
+	lastContact  time.Time
+}
+
+func NewFollower(leaderURL string, db *datastore.Db) *Follower {
+	return &Follower{
+		leaderURL: leaderURL,
+		db:        db,
+		client:    new(http.Client),
+	}
+}
+
+// SetAuthToken sets the bearer token sent to the leader. It must be called
+// before Run.
+func (f *Follower) SetAuthToken(token string) {
+	f.authToken = token
+}
+
+// SetTLSConfig sets the TLS configuration of connections to an https
+// leader, e.g. its CA and a client certificate. It must be called before
+// Run.
+func (f *Follower) SetTLSConfig(cfg *tls.Config) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	f.client = &http.Client{Transport: t}
+}
+
+// Run replicates until ctx is done, reconnecting to the leader after errors.
+func (f *Follower) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := f.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errResync) {
+			f.mu.Lock()
+			f.bootstrapped = false
+			f.mu.Unlock()
+		}
+		if err != nil {
+			log.Printf("replication from %s: %s", f.leaderURL, err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(RetryDelay):
+		}
+	}
+}
+
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := Status{
+		LeaderURL:    f.leaderURL,
+		Bootstrapped: f.bootstrapped,
+		AppliedSeq:   f.applied,
+		LeaderSeq:    f.leaderSeq,
+		LastContact:  f.lastContact,
+	}
+	if f.leaderSeq > f.applied {
+		st.Lag = f.leaderSeq - f.applied
+	}
+	return st
+}
+
+func (f *Follower) sync(ctx context.Context) error {
+	f.mu.Lock()
+	bootstrapped := f.bootstrapped
+	f.mu.Unlock()
+	if !bootstrapped {
+		if err := f.bootstrap(ctx); err != nil {
+			return err
+		}
+	}
+	return f.stream(ctx)
+}
+
+func (f *Follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leaderURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+f.authToken)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusGone:
+		resp.Body.Close()
+		return nil, errResync
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, path)
+	}
+}
+
+func (f *Follower) bootstrap(ctx context.Context) error {
+	resp, err := f.get(ctx, snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	var header message
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("bootstrap: cannot read snapshot header: %w", err)
+	}
+	if header.Type != msgSnapshot {
+		return fmt.Errorf("bootstrap: unexpected snapshot header %q", header.Type)
+	}
+
+	// Local keys missing from the snapshot are only deleted once its
+	// trailer proves that the snapshot is complete.
+	keys := make(map[string]struct{})
+	records := 0
+	for complete := false; !complete; {
+		var msg message
+		if err := dec.Decode(&msg); errors.Is(err, io.EOF) {
+			return errors.New("bootstrap: snapshot ended before its trailer")
+		} else if err != nil {
+			return fmt.Errorf("bootstrap: %w", err)
+		}
+		switch msg.Type {
+		case msgSnapshotEnd:
+			if msg.Count != records {
+				return fmt.Errorf("bootstrap: snapshot has %d records, trailer says %d", records, msg.Count)
+			}
+			complete = true
+		case msgError:
+			return fmt.Errorf("bootstrap: leader failed the snapshot: %s", msg.Error)
+		default:
+			if err := f.apply(msg); err != nil {
+				return fmt.Errorf("bootstrap: %w", err)
+			}
+			keys[msg.Key] = struct{}{}
+			records++
+		}
+	}
+
+	var stale []string
+	if err := f.db.Scan("", func(key, _ string) error {
+		if _, ok := keys[key]; !ok {
+			stale = append(stale, key)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+	for _, key := range stale {
+		if err := f.db.Delete(key); err != nil {
+			return fmt.Errorf("bootstrap: %w", err)
+		}
+	}
+
+	f.mu.Lock()
+	f.bootstrapped = true
+	f.applied = header.Seq
+	f.leaderSeq = max(f.leaderSeq, header.Seq)
+	f.lastContact = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Follower) apply(msg message) error {
+	if msg.ExpiresAt == 0 {
+		return f.db.PutTyped(msg.Key, msg.value(), msg.ContentType)
+	}
+	ttl := time.Until(time.Unix(0, msg.ExpiresAt))
+	if ttl <= 0 {
+		return f.db.Delete(msg.Key)
+	}
+	return f.db.PutTypedTTL(msg.Key, msg.value(), msg.ContentType, ttl)
+}
+
+func (f *Follower) stream(ctx context.Context) error {
+	f.mu.Lock()
+	after := f.applied
+	f.mu.Unlock()
+
+	resp, err := f.get(ctx, fmt.Sprintf("%s?after=%d", streamPath, after))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("stream: %w", err)
+		}
+
+		switch msg.Type {
+		case string(datastore.EventPut):
+			err = f.apply(msg)
+		case string(datastore.EventDelete):
+			err = f.db.Delete(msg.Key)
+		}
+		if err != nil {
+			return fmt.Errorf("stream: apply seq %d: %w", msg.Seq, err)
+		}
+
+		f.mu.Lock()
+		if msg.Type != msgHeartbeat {
+			f.applied = msg.Seq
+		}
+		f.leaderSeq = max(f.leaderSeq, msg.Seq)
+		f.lastContact = time.Now()
+		f.mu.Unlock()
+	}
+}
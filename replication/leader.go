@@ -0,0 +1,144 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+var HeartbeatInterval = time.Second
+
+const (
+	snapshotPath = "/replication/snapshot"
+	streamPath   = "/replication/stream"
+
+	msgSnapshot    = "snapshot"
+	msgSnapshotEnd = "snapshot-end"
+	msgError       = "error"
+	msgHeartbeat   = "heartbeat"
+)
+
+// message is a single line of the newline-delimited JSON replication
+// protocol shared by the snapshot and stream endpoints.
+type message struct {
+	Seq   uint64 `json:"seq"`
+	Type  string `json:"type"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Data replaces Value for values that are not valid UTF-8, which JSON
+	// strings cannot carry.
+	Data        []byte `json:"data,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	// ExpiresAt is a Unix time in nanoseconds of values written with a TTL.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Count is the number of records a snapshot-end message closes.
+	Count int `json:"count,omitempty"`
+	// Error tells why the leader aborted a snapshot.
+	Error string `json:"error,omitempty"`
+}
+
+// putMessage returns the message of a write described by ev.
+func putMessage(seq uint64, ev datastore.Event) message {
+	msg := message{Seq: seq, Type: string(datastore.EventPut), Key: ev.Key, ContentType: ev.ContentType}
+	if utf8.ValidString(ev.Value) {
+		msg.Value = ev.Value
+	} else {
+		msg.Data = []byte(ev.Value)
+	}
+	if !ev.ExpiresAt.IsZero() {
+		msg.ExpiresAt = ev.ExpiresAt.UnixNano()
+	}
+	return msg
+}
+
+func (m message) value() string {
+	if m.Data != nil {
+		return string(m.Data)
+	}
+	return m.Value
+}
+
+// NewLeaderHandler exposes the state of db to followers. The snapshot
+// endpoint sends every live record between a header with the sequence
+// number it is consistent with and a snapshot-end trailer with the record
+// count, or an error message when the scan fails. The stream endpoint tails
+// committed writes after a given sequence number.
+func NewLeaderHandler(db *datastore.Db) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(snapshotPath, func(rw http.ResponseWriter, r *http.Request) {
+		// The sequence number is taken before scanning, so the snapshot may
+		// already contain some later writes. Replaying them is harmless
+		// because the stream applies them again in commit order.
+		seq := db.LastSeq()
+
+		rw.Header().Set("content-type", "application/x-ndjson")
+		enc := json.NewEncoder(rw)
+		if err := enc.Encode(message{Seq: seq, Type: msgSnapshot}); err != nil {
+			return
+		}
+		count := 0
+		err := db.ScanEvents("", func(ev datastore.Event) error {
+			count++
+			return enc.Encode(putMessage(seq, ev))
+		})
+		if err != nil {
+			_ = enc.Encode(message{Seq: seq, Type: msgError, Error: err.Error()})
+			return
+		}
+		_ = enc.Encode(message{Seq: seq, Type: msgSnapshotEnd, Count: count})
+	})
+
+	mux.HandleFunc(streamPath, func(rw http.ResponseWriter, r *http.Request) {
+		after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		if err != nil {
+			http.Error(rw, "invalid position", http.StatusBadRequest)
+			return
+		}
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			http.Error(rw, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		events, err := db.Watch(ctx, "", after)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusGone)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		enc := json.NewEncoder(rw)
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			var msg message
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				msg = message{Seq: ev.Seq, Type: string(ev.Type), Key: ev.Key}
+				if ev.Type == datastore.EventPut {
+					msg = putMessage(ev.Seq, ev)
+				}
+			case <-ticker.C:
+				msg = message{Seq: db.LastSeq(), Type: msgHeartbeat}
+			}
+			if err := enc.Encode(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+	return mux
+}
@@ -0,0 +1,165 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func openDb(t *testing.T) *datastore.Db {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaderFollower(t *testing.T) {
+	oldHeartbeat, oldRetry := HeartbeatInterval, RetryDelay
+	HeartbeatInterval, RetryDelay = 20*time.Millisecond, 20*time.Millisecond
+	defer func() { HeartbeatInterval, RetryDelay = oldHeartbeat, oldRetry }()
+
+	leaderDb := openDb(t)
+	followerDb := openDb(t)
+
+	if err := leaderDb.Put("before", "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := followerDb.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaderDb.PutTypedTTL("typed-snapshot", "\x00", "image/png", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	leader := httptest.NewServer(NewLeaderHandler(leaderDb))
+	defer leader.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	follower := NewFollower(leader.URL, followerDb)
+	done := make(chan struct{})
+	go func() {
+		follower.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	eventually(t, "bootstrap", func() bool { return follower.Status().Bootstrapped })
+	if v, err := followerDb.Get("before"); err != nil || v != "snapshot" {
+		t.Errorf("snapshot record not replicated: (%q, %v)", v, err)
+	}
+	if _, err := followerDb.Get("stale"); err != datastore.ErrNotFound {
+		t.Errorf("expected stale follower key to be removed, got %v", err)
+	}
+
+	if err := leaderDb.Put("after", "stream"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaderDb.Delete("before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaderDb.PutTyped("blob", "\x00\xff", "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaderDb.PutTypedTTL("typed-stream", "\xff", "image/png", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "stream catch-up", func() bool {
+		st := follower.Status()
+		return st.AppliedSeq == leaderDb.LastSeq() && st.Lag == 0
+	})
+	if v, err := followerDb.Get("after"); err != nil || v != "stream" {
+		t.Errorf("streamed put not replicated: (%q, %v)", v, err)
+	}
+	if _, err := followerDb.Get("before"); err != datastore.ErrNotFound {
+		t.Errorf("streamed delete not replicated, got %v", err)
+	}
+	if v, ct, err := followerDb.GetTyped("blob"); err != nil || v != "\x00\xff" || ct != "application/octet-stream" {
+		t.Errorf("streamed binary value not replicated: (%q, %q, %v)", v, ct, err)
+	}
+
+	// Typed values keep their TTL through the snapshot and the stream.
+	expiring := map[string]bool{}
+	if err := followerDb.ScanEvents("typed-", func(ev datastore.Event) error {
+		expiring[ev.Key] = ev.ContentType == "image/png" && time.Until(ev.ExpiresAt) > 59*time.Minute
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !expiring["typed-snapshot"] || !expiring["typed-stream"] {
+		t.Errorf("typed values with TTL not replicated: %v", expiring)
+	}
+}
+
+func TestFollower_IncompleteSnapshot(t *testing.T) {
+	leaderDb := openDb(t)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := leaderDb.Put(key, "leader"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	NewLeaderHandler(leaderDb).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, snapshotPath, nil))
+	snapshot := rec.Body.String()
+	// The header, three records and the trailer.
+	lines := strings.SplitAfter(strings.TrimSuffix(snapshot, "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("snapshot has %d lines: %q", len(lines), snapshot)
+	}
+
+	failed, _ := json.Marshal(message{Type: msgError, Error: "disk failure"})
+	wrongCount, _ := json.Marshal(message{Type: msgSnapshotEnd, Count: 5})
+	for name, body := range map[string]string{
+		"complete":    snapshot,
+		"cut":         strings.Join(lines[:2], ""),
+		"cut in line": strings.Join(lines[:2], "") + lines[2][:5],
+		"error":       strings.Join(lines[:2], "") + string(failed) + "\n",
+		"count":       strings.Join(lines[:4], "") + string(wrongCount) + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			leader := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				_, _ = rw.Write([]byte(body))
+			}))
+			defer leader.Close()
+			followerDb := openDb(t)
+			if err := followerDb.Put("local", "value"); err != nil {
+				t.Fatal(err)
+			}
+
+			complete := body == snapshot
+			follower := NewFollower(leader.URL, followerDb)
+			if err := follower.bootstrap(context.Background()); (err == nil) != complete {
+				t.Fatalf("bootstrap returned %v", err)
+			}
+			if follower.Status().Bootstrapped != complete {
+				t.Errorf("Bootstrapped = %t", !complete)
+			}
+			if _, err := followerDb.Get("local"); (err == nil) == complete {
+				t.Errorf("Get of the local key returned %v", err)
+			}
+		})
+	}
+}